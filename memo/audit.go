@@ -0,0 +1,230 @@
+package memo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+func memoAuditFilePath() string { return path.Join(memoDirPath(), "audit.gobbin") }
+
+// auditState remembers the files seen in each watched directory at the
+// last audit, to tell which ones are new.
+type auditState struct {
+	Last  time.Time
+	Files map[string][]string
+}
+
+func loadAuditState() *auditState {
+	state := &auditState{Files: make(map[string][]string)}
+
+	dat, err := ioutil.ReadFile(memoAuditFilePath())
+	if err != nil {
+		return state
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(dat)).Decode(state); err != nil {
+		return &auditState{Files: make(map[string][]string)}
+	}
+
+	return state
+}
+
+func (a *auditState) save() error {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(*a); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(memoAuditFilePath(), buff.Bytes(), 0644)
+}
+
+// watchedFiles lists the files of a watched directory that should
+// have a memo.
+func watchedFiles(w watchedDir) ([]string, error) {
+	var files []string
+	dir := w.dir()
+
+	consider := func(p string, fi os.FileInfo) {
+		if fi.IsDir() {
+			return
+		}
+		if w.Executables && (!fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0) {
+			return
+		}
+		files = append(files, p)
+	}
+
+	if !w.Recursive {
+		infos, err := readDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range infos {
+			consider(filepath.Join(dir, fi.Name()), fi)
+		}
+	} else {
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			consider(p, fi)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+type auditFinding struct {
+	kind string
+	path string
+	note string
+}
+
+// audit goes over the watched directories, reporting files without
+// memos, files that showed up since the last audit and memos of files
+// that are gone. Anything needing attention makes it return an error
+// so that it can gate a login script.
+func audit() error {
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(conf.Watch) == 0 {
+		return fmt.Errorf("no watched directories; add some with -watch, or in %v", memoConfigFilePath())
+	}
+
+	stores, err := visibleStores()
+	if err != nil {
+		return err
+	}
+	memos := memoStoreNew()
+	for i := len(stores) - 1; i >= 0; i-- {
+		for k, v := range stores[i].memos.Data {
+			memos.Data[k] = v
+		}
+	}
+
+	state := loadAuditState()
+	var findings []auditFinding
+	problems := 0
+
+	for _, w := range conf.Watch {
+		files, err := watchedFiles(w)
+		if err != nil {
+			findings = append(findings, auditFinding{"unreadable", w.dir(), err.Error()})
+			problems++
+			continue
+		}
+
+		seen := make(map[string]bool)
+		previous, audited := state.Files[w.dir()]
+		for _, f := range previous {
+			seen[f] = true
+		}
+
+		for _, f := range files {
+			rec, documented := memos.Data[f]
+			switch {
+			case audited && !seen[f] && documented:
+				findings = append(findings, auditFinding{"new", f, rec.Data})
+			case audited && !seen[f]:
+				findings = append(findings, auditFinding{"new", f, "(no memo)"})
+				problems++
+			case !documented:
+				findings = append(findings, auditFinding{"undocumented", f, ""})
+				problems++
+			}
+		}
+
+		for _, k := range sortedKeys(memos, w.dir(), w.Recursive) {
+			if _, err := os.Lstat(k); os.IsNotExist(err) {
+				findings = append(findings, auditFinding{"vanished", k, memos.Data[k].Data})
+				problems++
+			}
+		}
+
+		state.Files[w.dir()] = files
+	}
+
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	for _, f := range findings {
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", f.kind, f.path, f.note)
+	}
+	writer.Flush()
+
+	state.Last = time.Now()
+	if err := state.save(); err != nil {
+		return err
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("audit found %v files needing attention", problems)
+	}
+
+	return nil
+}
+
+func watch(dir string, executables, recursive bool) error {
+	abs, err := filepath.Abs(expandHome(dir))
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(abs); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("not a directory: %v", abs)
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	w := watchedDir{Path: abbreviateHome(abs), Executables: executables, Recursive: recursive}
+	for i := range conf.Watch {
+		if conf.Watch[i].dir() == abs {
+			w.Path = conf.Watch[i].Path
+			conf.Watch[i] = w
+			return conf.save()
+		}
+	}
+
+	conf.Watch = append(conf.Watch, w)
+	return conf.save()
+}
+
+func unwatch(dir string) error {
+	abs, err := filepath.Abs(expandHome(dir))
+	if err != nil {
+		return err
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	for i := range conf.Watch {
+		if conf.Watch[i].dir() == abs {
+			conf.Watch = append(conf.Watch[:i], conf.Watch[i+1:]...)
+			return conf.save()
+		}
+	}
+
+	return fmt.Errorf("not watching: %v", abs)
+}
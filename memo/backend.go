@@ -0,0 +1,220 @@
+package memo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// memoBackend is somewhere memos can be kept. Changes may be held
+// until Close. A Store is one.
+type memoBackend interface {
+	Get(key string) (*Record, error)
+	Put(key, text string) (*Record, error)
+	Delete(key string) error
+	Schedule(key string, reviewBy, expires time.Time) error
+	Close() error
+}
+
+func checkBackend(name string) error {
+	switch name {
+	case "", "store", "xattr":
+		return nil
+	}
+	return fmt.Errorf("no such memo backend: %v", name)
+}
+
+func openBackend(name string) (memoBackend, error) {
+	if err := checkBackend(name); err != nil {
+		return nil, err
+	}
+
+	central, err := openGlobal()
+	if err != nil {
+		return nil, err
+	}
+	if name == "xattr" && central.Encrypted() {
+		return nil, errors.New("memos on files are in the clear; the xattr backend does not go with an encrypted store")
+	}
+	return through(name, central), nil
+}
+
+// through puts the memos of central, the global store or a project
+// one, through the named backend.
+func through(name string, central memoBackend) memoBackend {
+	if name == "xattr" {
+		return &xattrBackend{central: central}
+	}
+	return central
+}
+
+// xattrBackend writes the memo on the file itself, so that it follows
+// the file around. Every memo is still mirrored in the central store
+// so that listing, searching and checking keep working; when the file
+// can not hold the attribute, the central store is all there is.
+type xattrBackend struct {
+	central memoBackend
+}
+
+func (x *xattrBackend) Get(key string) (*Record, error) {
+	rec, err := x.central.Get(key)
+	if (err == nil && !rec.Xattr) || !isFileKey(key) {
+		return rec, err
+	}
+
+	text, found, xerr := getXattr(key)
+	if xerr != nil && xerr != errXattrUnsupported {
+		return nil, xerr
+	}
+	if !found {
+		return rec, err
+	}
+
+	if err != nil {
+		return &Record{Data: text, Xattr: true}, nil
+	}
+
+	onFile := *rec
+	onFile.Data = text
+	return &onFile, nil
+}
+
+func (x *xattrBackend) Put(key, text string) (*Record, error) {
+	rec, err := x.central.Put(key, text)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isFileKey(key) {
+		return rec, nil
+	}
+
+	switch err := setXattr(key, text); err {
+	case nil:
+		rec.Xattr = true
+	case errXattrUnsupported:
+		log.Println("can not write memo on file, keeping it in the store:", key)
+	default:
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (x *xattrBackend) Delete(key string) error {
+	if !isFileKey(key) {
+		return x.central.Delete(key)
+	}
+
+	if err := removeXattr(key); err != nil && err != errXattrUnsupported && !os.IsNotExist(err) {
+		return err
+	}
+
+	return x.central.Delete(key)
+}
+
+func (x *xattrBackend) Schedule(key string, reviewBy, expires time.Time) error {
+	return x.central.Schedule(key, reviewBy, expires)
+}
+
+func (x *xattrBackend) Close() error {
+	return x.central.Close()
+}
+
+// syncXattrs reconciles the memos on files with the central store.
+// The file wins when both have the memo, since that is the copy that
+// travelled. Memos lost from the file (eg: an editor replaced it) are
+// written back, and files under dirs carrying a memo the store does
+// not know of are imported. With push, memos only in the store are
+// written onto their files too.
+func syncXattrs(dirs []string, push bool) error {
+	central, err := openGlobal()
+	if err != nil {
+		return err
+	}
+	memos := central.memos
+
+	var keys []string
+	for k := range memos.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		rec := memos.Data[key]
+		if (!rec.Xattr && !push) || !isFileKey(key) {
+			continue
+		}
+
+		if _, err := os.Lstat(key); err != nil {
+			continue
+		}
+
+		text, found, err := getXattr(key)
+		switch {
+		case err == errXattrUnsupported:
+			if rec.Xattr {
+				rec.Xattr = false
+				memos.touch(key)
+				fmt.Printf("store only\t%v\n", key)
+			}
+		case err != nil:
+			log.Println("could not read memo on file:", key, ":", err)
+		case found && text != rec.Data:
+			rec.Data = text
+			rec.Xattr = true
+			memos.touch(key)
+			fmt.Printf("from file\t%v\n", key)
+		case !found:
+			if err := setXattr(key, rec.Data); err != nil {
+				if err != errXattrUnsupported {
+					log.Println("could not write memo on file:", key, ":", err)
+				}
+				continue
+			}
+			rec.Xattr = true
+			memos.touch(key)
+			fmt.Printf("to file\t%v\n", key)
+		case !rec.Xattr:
+			rec.Xattr = true
+			memos.touch(key)
+		}
+	}
+
+	for _, dir := range dirs {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+
+		err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if _, ok := memos.Data[path]; ok {
+				return nil
+			}
+
+			text, found, err := getXattr(path)
+			if err != nil || !found {
+				return nil
+			}
+
+			rec, _ := central.Put(path, text)
+			rec.Xattr = true
+			fmt.Printf("imported\t%v\n", path)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return central.Close()
+}
+
+var errXattrUnsupported = errors.New("extended attributes not supported")
@@ -0,0 +1,83 @@
+package memo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+func memoConfigFilePath() string { return path.Join(memoDirPath(), "config.yaml") }
+
+// watchedDir is a directory where every file should have a memo, eg:
+// ~/.local/bin.
+type watchedDir struct {
+	Path        string `yaml:"path"`
+	Executables bool   `yaml:"executables,omitempty"`
+	Recursive   bool   `yaml:"recursive,omitempty"`
+}
+
+// dir is where w is on this computer. The path is kept as written in
+// the config, so that the config can go from one home to another.
+func (w watchedDir) dir() string { return expandHome(w.Path) }
+
+type memoConfig struct {
+	Watch []watchedDir `yaml:"watch"`
+
+	// AutoArchive moves expired memos to the archive whenever memo
+	// runs, instead of waiting for -archive.
+	AutoArchive bool `yaml:"auto-archive,omitempty"`
+}
+
+func loadConfig() (*memoConfig, error) {
+	conf := &memoConfig{}
+
+	dat, err := ioutil.ReadFile(memoConfigFilePath())
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(dat, conf); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+func (c *memoConfig) save() error {
+	dat, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(memoConfigFilePath(), dat, 0644)
+}
+
+// expandHome lets the config be written by hand with ~/ paths.
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return filepath.Join(os.Getenv("HOME"), p[1:])
+	}
+	return p
+}
+
+// abbreviateHome is expandHome the other way around.
+func abbreviateHome(p string) string {
+	home := os.Getenv("HOME")
+	if home == "" || home == "/" {
+		return p
+	}
+	if p == home {
+		return "~"
+	}
+	if strings.HasPrefix(p, home+string(filepath.Separator)) {
+		return "~/" + filepath.ToSlash(p[len(home)+1:])
+	}
+	return p
+}
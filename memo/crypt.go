@@ -0,0 +1,455 @@
+package memo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// An encrypted store is the gob of the plain one, sealed with
+// AES-256-GCM under a key derived from a passphrase with scrypt:
+//
+//   magic | version | log2(N) | r | p | salt | nonce | ciphertext
+//
+// Everything up to the nonce is authenticated along with the memos, so
+// the parameters can not be tampered with either.
+//
+// Only the global store is encrypted. Project stores are there to be
+// committed and shared; the capture log and the audit state, which have
+// paths and command lines but no memo text, stay in the clear next to
+// the store.
+
+var encryptedMagic = []byte("PSYMEMO\x00")
+
+const (
+	encryptedVersion = 1
+	saltSize         = 16
+	keySize          = 32
+
+	// scrypt costs, about 32MB and a tenth of a second
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	// what a store may ask for, a bit over what is written; the header
+	// is read before anything is authenticated, so a tampered one must
+	// not get to make scrypt take all the memory there is
+	maxScryptLogN = scryptLogN + 1
+	maxScryptR    = scryptR
+	maxScryptP    = 4 * scryptP
+
+	passphraseEnv    = "PSY_MEMO_PASSPHRASE"
+	newPassphraseEnv = "PSY_MEMO_NEW_PASSPHRASE"
+	sessionEnv       = "PSY_MEMO_SESSION"
+)
+
+func memoSessionsPath() string { return path.Join(memoDirPath(), "sessions") }
+
+// ErrLocked is returned by Open for an encrypted store; see
+// OpenEncrypted.
+var ErrLocked = errors.New("memo: the store is encrypted, a passphrase is needed")
+
+// ErrWrongPassphrase is returned when an encrypted store can not be
+// opened with the passphrase it was given. Tampering with the file looks
+// the same.
+var ErrWrongPassphrase = errors.New("memo: wrong passphrase, or the store was tampered with")
+
+// sealing is what an encrypted store needs to be written back.
+type sealing struct {
+	logN, r, p int
+	salt       []byte
+	key        []byte
+}
+
+func isEncrypted(dat []byte) bool { return bytes.HasPrefix(dat, encryptedMagic) }
+
+func newSealing(passphrase []byte) (*sealing, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("memo: empty passphrase")
+	}
+
+	sl := &sealing{logN: scryptLogN, r: scryptR, p: scryptP, salt: make([]byte, saltSize)}
+	if _, err := io.ReadFull(rand.Reader, sl.salt); err != nil {
+		return nil, err
+	}
+
+	var err error
+	sl.key, err = scryptKey(passphrase, sl.salt, 1<<uint(sl.logN), sl.r, sl.p, keySize)
+	return sl, err
+}
+
+func (sl *sealing) header() []byte {
+	h := append([]byte{}, encryptedMagic...)
+	h = append(h, encryptedVersion, byte(sl.logN), byte(sl.r), byte(sl.p))
+	return append(h, sl.salt...)
+}
+
+// parseSealing reads the header of an encrypted store, and returns the
+// rest of it. The key is left for the caller to derive.
+func parseSealing(dat []byte) (*sealing, []byte, error) {
+	size := len(encryptedMagic) + 4 + saltSize
+	if !isEncrypted(dat) || len(dat) < size {
+		return nil, nil, errors.New("memo: not an encrypted store")
+	}
+
+	h := dat[len(encryptedMagic):]
+	if h[0] != encryptedVersion {
+		return nil, nil, fmt.Errorf("memo: unknown encrypted store version %v", h[0])
+	}
+
+	sl := &sealing{logN: int(h[1]), r: int(h[2]), p: int(h[3])}
+	if sl.logN < 1 || sl.logN > maxScryptLogN || sl.r < 1 || sl.r > maxScryptR || sl.p < 1 || sl.p > maxScryptP {
+		return nil, nil, fmt.Errorf("memo: bad scrypt parameters (N=2^%v, r=%v, p=%v)", sl.logN, sl.r, sl.p)
+	}
+	sl.salt = append([]byte{}, h[4:4+saltSize]...)
+
+	return sl, dat[size:], nil
+}
+
+func (sl *sealing) derive(passphrase []byte) error {
+	key, err := scryptKey(passphrase, sl.salt, 1<<uint(sl.logN), sl.r, sl.p, keySize)
+	sl.key = key
+	return err
+}
+
+func (sl *sealing) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(sl.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (sl *sealing) seal(plain []byte) ([]byte, error) {
+	gcm, err := sl.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := sl.header()
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, plain, header), nil
+}
+
+func (sl *sealing) open(body []byte) ([]byte, error) {
+	gcm, err := sl.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) < gcm.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+
+	plain, err := gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], sl.header())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plain, nil
+}
+
+// OpenEncrypted opens a store that may be encrypted with passphrase.
+// Stores that are not encrypted open like they do with Open.
+func OpenEncrypted(path string, passphrase []byte) (*Store, error) {
+	return openSealed(path, func(sl *sealing) error { return sl.derive(passphrase) })
+}
+
+// openWithKey skips the key derivation, for a key kept by -unlock.
+func openWithKey(path string, key []byte) (*Store, error) {
+	return openSealed(path, func(sl *sealing) error {
+		sl.key = key
+		return nil
+	})
+}
+
+func openSealed(path string, unlock func(*sealing) error) (*Store, error) {
+	dat, err := readStore(path)
+	if err != nil || !isEncrypted(dat) {
+		return openData(path, dat, err)
+	}
+
+	sl, body, err := parseSealing(dat)
+	if err != nil {
+		return nil, err
+	}
+	if err := unlock(sl); err != nil {
+		return nil, err
+	}
+
+	plain, err := sl.open(body)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openData(path, plain, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sealing = sl
+	return s, nil
+}
+
+// Encrypted is true when the store is written encrypted.
+func (s *Store) Encrypted() bool { return s.sealing != nil }
+
+// Encrypt makes Close write the store encrypted with passphrase. On an
+// encrypted store, it changes the passphrase.
+func (s *Store) Encrypt(passphrase []byte) error {
+	sl, err := newSealing(passphrase)
+	if err != nil {
+		return err
+	}
+
+	s.sealing = sl
+	s.rewrite = true
+	return nil
+}
+
+// Decrypt makes Close write the store in the clear again.
+func (s *Store) Decrypt() {
+	s.sealing = nil
+	s.rewrite = true
+}
+
+// unlockedKey is kept once the global store was opened, so that the
+// passphrase is asked at most once per run.
+var unlockedKey []byte
+
+// openGlobal opens the global store, asking for the passphrase if it is
+// encrypted. PSY_MEMO_SESSION (see -unlock) or PSY_MEMO_PASSPHRASE
+// spare the asking.
+func openGlobal() (*Store, error) {
+	path := memoDataFilePath()
+
+	s, err := Open(path)
+	if err != ErrLocked {
+		return s, err
+	}
+
+	if unlockedKey == nil {
+		if env := os.Getenv(sessionEnv); env != "" {
+			key, err := sessionKey(env)
+			if err != nil {
+				return nil, err
+			}
+			unlockedKey = key
+		}
+	}
+
+	if unlockedKey != nil {
+		return openWithKey(path, unlockedKey)
+	}
+
+	passphrase := []byte(os.Getenv(passphraseEnv))
+	if len(passphrase) == 0 {
+		if passphrase, err = readPassphrase("memo passphrase: "); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err = OpenEncrypted(path, passphrase)
+	if err == nil && s.Encrypted() {
+		unlockedKey = s.sealing.key
+	}
+	return s, err
+}
+
+// readPassphrase asks on the terminal, with echo off.
+func readPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("memo: no terminal to ask for the passphrase on; set %v", passphraseEnv)
+	}
+	defer tty.Close()
+
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		cmd.Run()
+	}
+
+	fmt.Fprint(tty, prompt)
+	stty("-echo")
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	stty("echo")
+	fmt.Fprintln(tty)
+
+	if err != nil && line == "" {
+		return nil, err
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// newPassphrase asks twice, unless the environment variable name has
+// it.
+func newPassphrase(name string) ([]byte, error) {
+	if env := os.Getenv(name); env != "" {
+		return []byte(env), nil
+	}
+
+	first, err := readPassphrase("new memo passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := readPassphrase("again: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(first, again) {
+		return nil, errors.New("memo: the passphrases do not match")
+	}
+	return first, nil
+}
+
+// encryptStore is -encrypt, -rekey and -decrypt.
+func encryptStore(encrypt, rekey bool) error {
+	s, err := openGlobal()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !encrypt:
+		if !s.Encrypted() {
+			return errors.New("memo: the store is not encrypted")
+		}
+		s.Decrypt()
+
+	case s.Encrypted() && !rekey:
+		return errors.New("memo: the store is already encrypted; see -rekey")
+
+	case !s.Encrypted() && rekey:
+		return errors.New("memo: the store is not encrypted; see -encrypt")
+
+	default:
+		env := passphraseEnv
+		if rekey {
+			env = newPassphraseEnv
+		}
+		passphrase, err := newPassphrase(env)
+		if err != nil {
+			return err
+		}
+		if err := s.Encrypt(passphrase); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		return err
+	}
+	// the key the sessions have is not the key of the store anymore
+	return lock()
+}
+
+// unlock keeps the key of the store for a shell session, so that the
+// passphrase is asked once:
+//
+//	eval $(psy memo -unlock)
+//
+// The key is written sealed under a new one made up for the session,
+// and only that one is printed; neither is any good without the other.
+// -lock throws all of them away.
+func unlock() error {
+	s, err := openGlobal()
+	if err != nil {
+		return err
+	}
+	if !s.Encrypted() {
+		return errors.New("memo: the store is not encrypted")
+	}
+
+	session := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, session); err != nil {
+		return err
+	}
+
+	gcm, err := sessionAEAD(session)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(memoSessionsPath(), 0700); err != nil {
+		return err
+	}
+	sealed := gcm.Seal(nonce, nonce, s.sealing.key, nil)
+	if err := ioutil.WriteFile(sessionPath(session), sealed, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("export %v=%v\n", sessionEnv, hex.EncodeToString(session))
+	return nil
+}
+
+// lock ends every session started with -unlock.
+func lock() error {
+	return os.RemoveAll(memoSessionsPath())
+}
+
+func sessionAEAD(session []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(session)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sessionPath is where the key of a session is, named after a hash of
+// the session so that the name gives nothing away.
+func sessionPath(session []byte) string {
+	sum := sha256.Sum256(session)
+	return filepath.Join(memoSessionsPath(), hex.EncodeToString(sum[:8]))
+}
+
+// sessionKey is the key of the store kept for the session in env.
+func sessionKey(env string) ([]byte, error) {
+	session, err := hex.DecodeString(env)
+	if err != nil || len(session) != keySize {
+		return nil, fmt.Errorf("memo: %v is not a session from -unlock", sessionEnv)
+	}
+
+	sealed, err := ioutil.ReadFile(sessionPath(session))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("memo: the session in %v was locked; unset it, or -unlock again", sessionEnv)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := sessionAEAD(session)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("memo: %v is not a session from -unlock", sessionEnv)
+	}
+	key, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("memo: %v is not a session from -unlock", sessionEnv)
+	}
+	return key, nil
+}
@@ -0,0 +1,17 @@
+package memo
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime is when the inode last changed, which unlike the
+// modification time, moves when a file is renamed into place.
+func changeTime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package memo
+
+import (
+	"os"
+	"time"
+)
+
+func changeTime(fi os.FileInfo) time.Time { return fi.ModTime() }
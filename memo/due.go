@@ -0,0 +1,237 @@
+package memo
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// parseWhen reads a date (2006-01-02), or a duration from now. On top
+// of what time.ParseDuration knows, d and w are days and weeks.
+func parseWhen(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil {
+			break
+		}
+		return now.Add(time.Duration(n) * unit), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a date like 2006-01-02 or a duration like 30d: %v", s)
+	}
+
+	return now.Add(d), nil
+}
+
+// due is the earliest of the review and expiry dates, if any.
+func (r *Record) due() time.Time {
+	switch {
+	case r.ReviewBy.IsZero():
+		return r.Expires
+	case r.Expires.IsZero() || r.ReviewBy.Before(r.Expires):
+		return r.ReviewBy
+	}
+	return r.Expires
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !r.Expires.After(now)
+}
+
+// Schedule sets when the memo should be looked at again, and when it
+// expires. Zero times clear them.
+func (s *Store) Schedule(key string, reviewBy, expires time.Time) error {
+	return s.memos.schedule(key, reviewBy, expires)
+}
+
+func (s *memoStore) schedule(key string, reviewBy, expires time.Time) error {
+	rec, ok := s.Data[key]
+	if !ok {
+		return ErrNotFound
+	}
+
+	rec.ReviewBy = reviewBy
+	rec.Expires = expires
+	s.touch(key)
+	return nil
+}
+
+// Archive moves expired memos out of the way, into their own section
+// of the store, and returns their keys.
+func (s *Store) Archive(now time.Time) []string {
+	return s.memos.archive(now)
+}
+
+func (s *memoStore) archive(now time.Time) []string {
+	var archived []string
+	for k, v := range s.Data {
+		if !v.expired(now) {
+			continue
+		}
+
+		if s.Archive == nil {
+			s.Archive = make(map[string]*Record)
+		}
+		s.Archive[archiveKey(k, v)] = v
+		s.remove(k)
+		archived = append(archived, k)
+	}
+
+	sort.Strings(archived)
+	return archived
+}
+
+// archiveKey keeps memos archived from the same key apart, by when
+// they were written.
+func archiveKey(key string, rec *Record) string {
+	return key + "\x00" + rec.Written.UTC().Format("20060102150405.000000000")
+}
+
+// Archived returns the archived memos, sorted by key and then by when
+// they were written.
+func (s *Store) Archived() []Entry {
+	return s.memos.archived()
+}
+
+func (s *memoStore) archived() []Entry {
+	keys := make([]string, 0, len(s.Archive))
+	for k := range s.Archive {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		key := k
+		if i := strings.IndexByte(k, 0); i >= 0 {
+			key = k[:i]
+		}
+		entries = append(entries, Entry{Key: key, Record: s.Archive[k]})
+	}
+	return entries
+}
+
+// listDue prints the memos due for review or expiring before now plus
+// within, earliest first.
+func listDue(within time.Duration, format outputFormat) error {
+	stores, err := visibleStores()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	horizon := now.Add(within)
+
+	type dueMemo struct {
+		key   string
+		rec   *Record
+		store string
+	}
+	var due []dueMemo
+	for _, s := range stores {
+		for k, v := range s.memos.Data {
+			if when := v.due(); !when.IsZero() && !when.After(horizon) {
+				due = append(due, dueMemo{k, v, s.name})
+			}
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].rec.due().Before(due[j].rec.due()) })
+
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 1, '\t', 0)
+
+	var memos []memoOutput
+	for _, d := range due {
+		state := "review"
+		if !d.rec.Expires.IsZero() && d.rec.due().Equal(d.rec.Expires) {
+			state = "expires"
+		}
+		if !d.rec.due().After(now) {
+			state = "overdue"
+			if d.rec.expired(now) {
+				state = "expired"
+			}
+		}
+
+		if format != formatText {
+			m := outputOf(d.key, d.rec, d.store)
+			m.State = state
+			memos = append(memos, m)
+			continue
+		}
+
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", state, d.rec.due().Format("2006-01-02"), d.key, d.rec.Data)
+	}
+
+	if format != formatText {
+		return writeOutput(os.Stdout, format, memos, false)
+	}
+	return writer.Flush()
+}
+
+// archiveExpired is run by -archive, and on every run with the
+// auto-archive config option.
+func archiveExpired(verbose bool) error {
+	stores, err := visibleStores()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stores {
+		for _, k := range s.memos.archive(time.Now()) {
+			if verbose {
+				fmt.Printf("archived\t%v\n", k)
+			}
+		}
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listArchived(format outputFormat) error {
+	stores, err := visibleStores()
+	if err != nil {
+		return err
+	}
+
+	if format != formatText {
+		var memos []memoOutput
+		for _, s := range stores {
+			for _, e := range s.memos.archived() {
+				m := outputOf(e.Key, e.Record, "archive")
+				m.From = s.name
+				memos = append(memos, m)
+			}
+		}
+		return writeOutput(os.Stdout, format, memos, false)
+	}
+
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 1, '\t', 0)
+
+	for _, s := range stores {
+		for _, e := range s.memos.archived() {
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", shownID(e.Record, s.name), e.Record.Expires.Format("2006-01-02"), e.Key, e.Record.Data)
+		}
+	}
+
+	return writer.Flush()
+}
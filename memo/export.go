@@ -0,0 +1,372 @@
+package memo
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportedMemo is what a memo looks like once it leaves the store.
+type exportedMemo struct {
+	Id      uint64    `json:"id"`
+	Path    string    `json:"path"`
+	Text    string    `json:"text"`
+	Written time.Time `json:"written"`
+	Size    int64     `json:"size,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+
+	ReviewBy *time.Time `json:"review_by,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+
+	// the memo is on the file too
+	Xattr bool `json:"xattr,omitempty"`
+}
+
+func (m exportedMemo) record() *Record {
+	rec := &Record{Id: m.Id, Data: m.Text, Written: m.Written, Size: m.Size, Hash: m.Hash, Xattr: m.Xattr}
+	if m.ReviewBy != nil {
+		rec.ReviewBy = *m.ReviewBy
+	}
+	if m.Expires != nil {
+		rec.Expires = *m.Expires
+	}
+	return rec
+}
+
+// optionalTime is nil for zero times, so that they can be omitted.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// exportedStore carries the home directory of the machine it was
+// exported from, so that paths can be moved to the importing home.
+type exportedStore struct {
+	Home  string         `json:"home,omitempty"`
+	Memos []exportedMemo `json:"memos"`
+
+	// only project stores keep their archive in the file
+	Archive []exportedMemo `json:"archive,omitempty"`
+}
+
+func exportedMemoOf(key string, rec *Record) exportedMemo {
+	return exportedMemo{
+		Id:      rec.Id,
+		Path:    key,
+		Text:    rec.Data,
+		Written: rec.Written,
+		Size:    rec.Size,
+		Hash:    rec.Hash,
+
+		ReviewBy: optionalTime(rec.ReviewBy),
+		Expires:  optionalTime(rec.Expires),
+		Xattr:    rec.Xattr,
+	}
+}
+
+func exportStore(memos *memoStore) *exportedStore {
+	exported := &exportedStore{Home: os.Getenv("HOME")}
+	for _, k := range sortedKeys(memos, "", false) {
+		exported.Memos = append(exported.Memos, exportedMemoOf(k, memos.Data[k]))
+	}
+	return exported
+}
+
+var csvHeader = []string{"id", "path", "written", "text"}
+
+func writeExport(w io.Writer, exported *exportedStore, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exported)
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, m := range exported.Memos {
+			cw.Write([]string{
+				strconv.FormatUint(m.Id, 10),
+				m.Path,
+				formatTime(m.Written),
+				m.Text,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "md", "markdown":
+		fmt.Fprintln(w, "| Id | Path | Written | Memo |")
+		fmt.Fprintln(w, "|---:|------|---------|------|")
+		for _, m := range exported.Memos {
+			fmt.Fprintf(w, "| %v | %v | %v | %v |\n",
+				m.Id, mdEscape(m.Path), formatTime(m.Written), mdEscape(m.Text))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown export format: %v", format)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+var mdReplacer = strings.NewReplacer(`\`, `\\`, "|", `\|`, "\n", "<br>")
+var mdUnreplacer = strings.NewReplacer(`\\`, `\`, `\|`, "|", "<br>", "\n")
+
+func mdEscape(s string) string   { return mdReplacer.Replace(s) }
+func mdUnescape(s string) string { return mdUnreplacer.Replace(s) }
+
+// splitMdRow splits a markdown table row on the pipes that are not
+// escaped.
+func splitMdRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			cell.WriteByte(line[i])
+			cell.WriteByte(line[i+1])
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+
+	if rest := strings.TrimSpace(cell.String()); rest != "" {
+		cells = append(cells, rest)
+	}
+	return cells
+}
+
+func readExport(path string) (*exportedStore, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := &exportedStore{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		records, err := csv.NewReader(strings.NewReader(string(dat))).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, rec := range records {
+			if i == 0 && rec[0] == csvHeader[0] {
+				continue
+			}
+			if len(rec) != len(csvHeader) {
+				return nil, fmt.Errorf("%v: line %v: expected %v columns", path, i+1, len(csvHeader))
+			}
+			id, _ := strconv.ParseUint(rec[0], 10, 64)
+			exported.Memos = append(exported.Memos, exportedMemo{
+				Id: id, Path: rec[1], Written: parseTime(rec[2]), Text: rec[3],
+			})
+		}
+
+	case ".md", ".markdown":
+		for i, line := range strings.Split(string(dat), "\n") {
+			cells := splitMdRow(line)
+			if len(cells) != 4 || cells[0] == "Id" || strings.HasPrefix(cells[0], "---") {
+				continue
+			}
+			id, err := strconv.ParseUint(cells[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%v: line %v: bad id: %v", path, i+1, cells[0])
+			}
+			exported.Memos = append(exported.Memos, exportedMemo{
+				Id:      id,
+				Path:    mdUnescape(cells[1]),
+				Written: parseTime(cells[2]),
+				Text:    mdUnescape(cells[3]),
+			})
+		}
+
+	default:
+		if err := json.Unmarshal(dat, exported); err != nil {
+			return nil, err
+		}
+	}
+
+	return exported, nil
+}
+
+// remapHome moves a path from the home of the exporting machine to
+// ours.
+func remapHome(path, from, to string) string {
+	from = strings.TrimSuffix(from, "/")
+	if from == "" || to == "" || from == to {
+		return path
+	}
+
+	if path == from {
+		return to
+	}
+	if strings.HasPrefix(path, from+"/") {
+		return filepath.Join(to, path[len(from)+1:])
+	}
+	return path
+}
+
+type conflictPolicy string
+
+const (
+	conflictNewer  conflictPolicy = "newer"
+	conflictLocal  conflictPolicy = "local"
+	conflictRemote conflictPolicy = "remote"
+	conflictAsk    conflictPolicy = "ask"
+)
+
+// resolve returns the memo text to keep, when the local and imported
+// memos disagree.
+func (p conflictPolicy) resolve(in *bufio.Reader, key string, local *Record, remote exportedMemo) (string, error) {
+	switch p {
+	case conflictLocal:
+		return local.Data, nil
+	case conflictRemote:
+		return remote.Text, nil
+	case conflictNewer:
+		if remote.Written.After(local.Written) {
+			return remote.Text, nil
+		}
+		return local.Data, nil
+	case conflictAsk:
+		for {
+			fmt.Printf("conflict on %v\n  local  (%v): %v\n  remote (%v): %v\n",
+				key, formatTime(local.Written), local.Data, formatTime(remote.Written), remote.Text)
+			fmt.Print("keep [l]ocal, take [r]emote or [b]oth? ")
+
+			answer, err := in.ReadString('\n')
+			if err != nil && answer == "" {
+				return "", err
+			}
+
+			switch strings.TrimSpace(answer) {
+			case "l":
+				return local.Data, nil
+			case "r":
+				return remote.Text, nil
+			case "b":
+				return local.Data + "\n" + remote.Text, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("unknown conflict policy: %v", p)
+}
+
+// importStore merges another store into ours. Imported memos always
+// get fresh ids, since the ones from the other machine mean nothing
+// here.
+func importStore(memos *memoStore, exported *exportedStore, remoteHome string, policy conflictPolicy) (int, error) {
+	if remoteHome == "" {
+		remoteHome = exported.Home
+	}
+	localHome := os.Getenv("HOME")
+	in := bufio.NewReader(os.Stdin)
+
+	imported := 0
+	for _, m := range exported.Memos {
+		if m.Path == "" {
+			continue
+		}
+		key := remapHome(m.Path, remoteHome, localHome)
+
+		local, exists := memos.Data[key]
+		text := m.Text
+		if exists {
+			if local.Data == m.Text {
+				continue
+			}
+
+			var err error
+			text, err = policy.resolve(in, key, local, m)
+			if err != nil {
+				return imported, err
+			}
+			if text == local.Data {
+				continue
+			}
+		}
+
+		rec := m.record()
+		rec.Data = text
+		rec.Xattr = false // whatever was on the file did not come along
+		if text != m.Text || rec.Written.IsZero() {
+			rec.Written = time.Now()
+		}
+		if exists {
+			rec.Device, rec.Inode = local.Device, local.Inode
+			rec.Size, rec.Hash = local.Size, local.Hash
+			rec.Xattr = local.Xattr && setXattr(key, text) == nil
+		} else if _, err := os.Stat(key); err == nil {
+			fingerprint(key, rec)
+		}
+
+		if exists {
+			// the memo changed, it is still the same memo
+			rec.Id = local.Id
+			memos.Data[key] = rec
+			memos.touch(key)
+		} else {
+			memos.insert(key, rec)
+		}
+		imported++
+	}
+
+	return imported, nil
+}
+
+func importFile(path, remoteHome, policy string) error {
+	exported, err := readExport(path)
+	if err != nil {
+		return err
+	}
+
+	switch conflictPolicy(policy) {
+	case conflictNewer, conflictLocal, conflictRemote, conflictAsk:
+	default:
+		return errors.New("conflict policy should be one of newer, local, remote or ask")
+	}
+
+	theStore, err := openGlobal()
+	if err != nil {
+		return err
+	}
+
+	imported, err := importStore(theStore.memos, exported, remoteHome, conflictPolicy(policy))
+	if cerr := theStore.Close(); err == nil {
+		err = cerr
+	}
+
+	fmt.Println("imported memos:", imported)
+	return err
+}
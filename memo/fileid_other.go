@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package memo
+
+import "os"
+
+// fileID is not available here; renames are only found by content.
+func fileID(fi os.FileInfo) (uint64, uint64, bool) {
+	return 0, 0, false
+}
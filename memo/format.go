@@ -0,0 +1,127 @@
+package memo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+// outputFormat is how the read commands print memos; text is for
+// people, the rest for scripts.
+type outputFormat string
+
+const (
+	formatText outputFormat = "text"
+	formatJSON outputFormat = "json"
+	formatYAML outputFormat = "yaml"
+	formatTSV  outputFormat = "tsv"
+)
+
+func parseFormat(s string) (outputFormat, error) {
+	switch f := outputFormat(s); f {
+	case formatText, formatJSON, formatYAML, formatTSV:
+		return f, nil
+	}
+	return "", fmt.Errorf("no such format: %v (want text, json, yaml or tsv)", s)
+}
+
+// memoOutput is the schema of the json, yaml and tsv output, described
+// in the package doc. Fields get added, never renamed or removed.
+type memoOutput struct {
+	Id       uint64  `json:"id" yaml:"id"`
+	Kind     string  `json:"kind" yaml:"kind"`
+	Key      string  `json:"key" yaml:"key"`
+	Text     string  `json:"text" yaml:"text"`
+	Written  string  `json:"written,omitempty" yaml:"written,omitempty"`
+	ReviewBy string  `json:"review_by,omitempty" yaml:"review_by,omitempty"`
+	Expires  string  `json:"expires,omitempty" yaml:"expires,omitempty"`
+	Store    string  `json:"store,omitempty" yaml:"store,omitempty"`
+	Score    float64 `json:"score,omitempty" yaml:"score,omitempty"`
+	State    string  `json:"state,omitempty" yaml:"state,omitempty"`
+	From     string  `json:"from,omitempty" yaml:"from,omitempty"`
+}
+
+var outputColumns = []string{"id", "kind", "key", "text", "written", "review_by", "expires", "store", "score", "state", "from"}
+
+func outputTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func outputOf(key string, rec *Record, store string) memoOutput {
+	return memoOutput{
+		Id:       rec.Id,
+		Kind:     string(subjectOf(key).kind),
+		Key:      key,
+		Text:     rec.Data,
+		Written:  outputTime(rec.Written),
+		ReviewBy: outputTime(rec.ReviewBy),
+		Expires:  outputTime(rec.Expires),
+		Store:    store,
+	}
+}
+
+func (m memoOutput) columns() []string {
+	score := ""
+	if m.Score != 0 {
+		score = strconv.FormatFloat(m.Score, 'f', 4, 64)
+	}
+
+	return []string{
+		strconv.FormatUint(m.Id, 10), m.Kind, m.Key, m.Text,
+		m.Written, m.ReviewBy, m.Expires, m.Store, score, m.State, m.From,
+	}
+}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// writeOutput prints memos in one of the machine formats. A single memo
+// (reading one) is an object; anything else is a list, even when empty
+// or of one.
+func writeOutput(w io.Writer, format outputFormat, memos []memoOutput, single bool) error {
+	var v interface{} = memos
+	if single && len(memos) == 1 {
+		v = memos[0]
+	} else if memos == nil {
+		v = []memoOutput{}
+	}
+
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+
+	case formatYAML:
+		dat, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(dat)
+		return err
+
+	case formatTSV:
+		if _, err := fmt.Fprintln(w, strings.Join(outputColumns, "\t")); err != nil {
+			return err
+		}
+		for _, m := range memos {
+			cols := m.columns()
+			for i := range cols {
+				cols[i] = tsvEscaper.Replace(cols[i])
+			}
+			if _, err := fmt.Fprintln(w, strings.Join(cols, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%v is not a machine format", format)
+}
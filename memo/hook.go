@@ -0,0 +1,228 @@
+package memo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+func memoCaptureFilePath() string { return path.Join(memoDirPath(), "captures.log") }
+
+// The hooks remember the command line and when it started, and hand
+// them to -capture once the command is done. They all call the psy
+// they were printed by.
+const bashHook = `# psy memo: offer memos for files that land in watched directories
+__psy_memo_preexec() {
+    [ -n "$COMP_LINE" ] && return
+    [ -n "$__psy_memo_prompt" ] && return
+    [ "$BASH_COMMAND" = "__psy_memo_prompt=1" ] && return
+    [ -n "$__psy_memo_cmd" ] && return
+    __psy_memo_cmd=$(HISTTIMEFORMAT= history 1 | sed 's/^ *[0-9]* *//')
+    __psy_memo_since=${EPOCHSECONDS:-$(date +%%s)}
+}
+__psy_memo_precmd() {
+    if [ -n "$__psy_memo_cmd" ]; then
+        %[1]s memo -since "$__psy_memo_since" -capture "$__psy_memo_cmd"
+    fi
+    __psy_memo_cmd=
+}
+trap '__psy_memo_preexec' DEBUG
+# the trap goes off for everything in PROMPT_COMMAND too, which is no
+# command of the user's
+PROMPT_COMMAND="__psy_memo_prompt=1; __psy_memo_precmd${PROMPT_COMMAND:+; $PROMPT_COMMAND}; __psy_memo_prompt="
+`
+
+const zshHook = `# psy memo: offer memos for files that land in watched directories
+zmodload zsh/datetime
+autoload -Uz add-zsh-hook
+__psy_memo_preexec() {
+    __psy_memo_cmd="$1"
+    __psy_memo_since=$EPOCHSECONDS
+}
+__psy_memo_precmd() {
+    if [[ -n "$__psy_memo_cmd" ]]; then
+        %[1]s memo -since "$__psy_memo_since" -capture "$__psy_memo_cmd"
+    fi
+    __psy_memo_cmd=
+}
+add-zsh-hook preexec __psy_memo_preexec
+add-zsh-hook precmd __psy_memo_precmd
+`
+
+const fishHook = `# psy memo: offer memos for files that land in watched directories
+function __psy_memo_preexec --on-event fish_preexec
+    set -g __psy_memo_since (date +%%s)
+end
+function __psy_memo_postexec --on-event fish_postexec
+    %[1]s memo -since "$__psy_memo_since" -capture "$argv"
+end
+`
+
+// shellHook prints the snippet to source from the shell's rc file.
+func shellHook(shell string) error {
+	hooks := map[string]string{"bash": bashHook, "zsh": zshHook, "fish": fishHook}
+
+	hook, ok := hooks[shell]
+	if !ok {
+		return fmt.Errorf("no hook for shell %q; try bash, zsh or fish", shell)
+	}
+
+	psy, err := os.Executable()
+	if err != nil {
+		psy = "psy"
+	}
+
+	quoted := "'" + strings.Replace(psy, "'", `'\''`, -1) + "'"
+	if shell == "fish" {
+		quoted = "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(psy) + "'"
+	}
+
+	fmt.Printf(hook, quoted)
+	return nil
+}
+
+// capturedChange is a line of the capture log.
+type capturedChange struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Path    string    `json:"path"`
+	Saved   bool      `json:"saved"`
+}
+
+func appendCaptures(changes []capturedChange) error {
+	file, err := os.OpenFile(memoCaptureFilePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	for _, c := range changes {
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// changedSince lists the files of watched directories that were
+// written, or moved in, since the given time.
+func changedSince(conf *memoConfig, since time.Time) []string {
+	var changed []string
+	for _, w := range conf.Watch {
+		files, err := watchedFiles(w)
+		if err != nil {
+			continue
+		}
+
+		for _, f := range files {
+			fi, err := os.Lstat(f)
+			if err != nil {
+				continue
+			}
+			if !fi.ModTime().Before(since) || !changeTime(fi).Before(since) {
+				changed = append(changed, f)
+			}
+		}
+	}
+	return changed
+}
+
+// capture is called by the shell hook after every command. Files the
+// command put in watched directories go in the capture log, and if
+// there is someone at the terminal, they are offered a memo for the
+// ones without any.
+func capture(command string, sinceUnix int64) error {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return nil
+	}
+
+	conf, err := loadConfig()
+	if err != nil || len(conf.Watch) == 0 {
+		return err
+	}
+
+	now := time.Now()
+	changed := changedSince(conf, time.Unix(sinceUnix, 0))
+	if len(changed) == 0 {
+		return nil
+	}
+
+	interactive := false
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		interactive = true
+	}
+
+	stores, err := visibleStores()
+	if err != nil {
+		return err
+	}
+	documented := func(f string) bool {
+		for _, s := range stores {
+			if _, ok := s.memos.Data[f]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	// new memos go where -file would put them
+	storeFor := func(f string) memoBackend {
+		for _, s := range stores {
+			if s.project != nil && s.project.contains(f) {
+				return s.project
+			}
+			if s.store != nil {
+				return s.store
+			}
+		}
+		return nil
+	}
+	in := bufio.NewReader(os.Stdin)
+
+	var changes []capturedChange
+	for _, f := range changed {
+		change := capturedChange{Time: now, Command: command, Path: f}
+
+		if !documented(f) && interactive {
+			proposal := fmt.Sprintf("installed with `%v` on %v", command, now.Format("2006-01-02 15:04"))
+			fmt.Printf("psy memo: %v changed after `%v`\n", f, command)
+			fmt.Printf("  memo (enter to keep, - to skip) [%v]: ", proposal)
+
+			answer, err := in.ReadString('\n')
+			if err != nil && answer == "" {
+				// nobody there after all, eg: /dev/null
+				fmt.Println()
+				interactive = false
+				changes = append(changes, change)
+				continue
+			}
+			answer = strings.TrimSpace(answer)
+			if answer == "" {
+				answer = proposal
+			}
+
+			if answer != "-" {
+				if _, err := storeFor(f).Put(f, answer); err != nil {
+					return err
+				}
+				change.Saved = true
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	for _, s := range stores {
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+
+	return appendCaptures(changes)
+}
@@ -0,0 +1,189 @@
+package memo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// inDir tells whether key lives in dir, or anywhere below it when
+// recursive.
+func inDir(key, dir string, recursive bool) bool {
+	if !recursive {
+		return filepath.Dir(key) == dir
+	}
+	return strings.HasPrefix(key, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func sortedKeys(memos *memoStore, dir string, recursive bool) []string {
+	var keys []string
+	for k := range memos.Data {
+		if dir == "" || inDir(k, dir, recursive) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// list prints memos sorted by path, optionally only the ones under
+// dir. The tree output shows the files without memos too. When there
+// is more than one store, a column tells which one each memo is from.
+func list(stores []namedStore, dir string, recursive, tree bool, format outputFormat) error {
+	if tree && format != formatText {
+		return fmt.Errorf("-tree is only rendered as text, not %v", format)
+	}
+
+	if dir != "" || tree {
+		if dir == "" {
+			dir = "."
+		}
+
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		dir = abs
+	}
+
+	merged := memoStoreNew()
+	from := make(map[string]string)
+	for i := len(stores) - 1; i >= 0; i-- {
+		for k, v := range stores[i].memos.Data {
+			merged.Data[k] = v
+			from[k] = stores[i].name
+		}
+	}
+
+	if format != formatText {
+		var memos []memoOutput
+		for _, k := range sortedKeys(merged, dir, recursive) {
+			memos = append(memos, outputOf(k, merged.Data[k], from[k]))
+		}
+		return writeOutput(os.Stdout, format, memos, false)
+	}
+
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 1, '\t', 0)
+
+	if tree {
+		root := buildTree(merged, dir, recursive)
+		fmt.Fprintf(writer, "%v\t\n", dir)
+		root.render(writer, merged, "")
+		return writer.Flush()
+	}
+
+	for _, k := range sortedKeys(merged, dir, recursive) {
+		v := merged.Data[k]
+		if len(stores) > 1 {
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", shownID(v, from[k]), from[k], k, v.Data)
+		} else {
+			fmt.Fprintf(writer, "%v\t%v\t%v\n", shownID(v, from[k]), k, v.Data)
+		}
+	}
+
+	return writer.Flush()
+}
+
+type treeNode struct {
+	name     string
+	path     string
+	dir      bool
+	missing  bool
+	children map[string]*treeNode
+}
+
+func (n *treeNode) child(name string) *treeNode {
+	if n.children == nil {
+		n.children = make(map[string]*treeNode)
+	}
+
+	c, ok := n.children[name]
+	if !ok {
+		c = &treeNode{name: name, path: filepath.Join(n.path, name)}
+		n.children[name] = c
+	}
+	return c
+}
+
+// buildTree lays out what is on disk under dir, along with memos of
+// files that are not there anymore.
+func buildTree(memos *memoStore, dir string, recursive bool) *treeNode {
+	root := &treeNode{path: dir, dir: true}
+
+	var walk func(n *treeNode)
+	walk = func(n *treeNode) {
+		infos, err := readDir(n.path)
+		if err != nil {
+			return
+		}
+
+		for _, fi := range infos {
+			c := n.child(fi.Name())
+			c.dir = fi.IsDir()
+			if c.dir && recursive {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+
+	for _, k := range sortedKeys(memos, dir, recursive) {
+		rel, err := filepath.Rel(dir, k)
+		if err != nil {
+			continue
+		}
+
+		n := root
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if _, ok := n.children[part]; !ok {
+				n.child(part).missing = true
+			}
+			n = n.children[part]
+		}
+	}
+
+	return root
+}
+
+func (n *treeNode) render(w io.Writer, memos *memoStore, indent string) {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		c := n.children[name]
+
+		branch, next := "├── ", "│   "
+		if i == len(names)-1 {
+			branch, next = "└── ", "    "
+		}
+
+		label := c.name
+		if c.dir {
+			label += "/"
+		}
+
+		note := ""
+		if rec, ok := memos.Data[c.path]; ok {
+			note = rec.Data
+		} else if !c.dir {
+			note = "(no memo)"
+		}
+		if c.missing {
+			note = strings.TrimSpace("(missing) " + note)
+		}
+
+		fmt.Fprintf(w, "%v%v%v\t%v\n", indent, branch, label, note)
+
+		if len(c.children) > 0 {
+			c.render(w, memos, indent+next)
+		}
+	}
+}
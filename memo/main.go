@@ -7,6 +7,44 @@ why the hell I've installed ~/.local/bin/satan. This is a shitty way
 to just add notes in a familiar and quick way, and maintain a key
 value store my computer to recheck why I originally did such a thing.
 
+Other tools can read and write the same memos through Store:
+
+  s, err := memo.Open(memo.DefaultPath())
+  if err != nil {
+    return err
+  }
+  key, _ := memo.Key("/home/me/.local/bin/satan")
+  s.Put(key, "the devil made me do it")
+  return s.Close()
+
+The store can be encrypted with a passphrase (-encrypt); OpenEncrypted
+opens those, and Open gives ErrLocked. Only the memos of the global
+store are encrypted: project stores (.psy-memo) are meant to be shared
+and stay in the clear, and so do the capture log and the audit state.
+
+Reading a memo, -list, -search, -due and -list -archived take
+-format json, yaml or tsv for scripts. Reading one memo gives an
+object, the rest a list of them. The fields are:
+
+  id         number, unique within the store; project memos are
+             numbered apart from global ones (text output shows p3)
+  kind       file, url, pkg, cmd or key
+  key        the absolute path of files, kind:value for the rest
+  text       the memo
+  written    RFC 3339, in UTC
+  review_by  RFC 3339, if set
+  expires    RFC 3339, if set
+  store      global, project or archive
+  score      with -search, higher is better
+  state      with -due; review, expires, overdue or expired
+  from       with -list -archived; global or project, the store the
+             archive is in
+
+tsv has a header row with these names, in this order, and escapes
+tabs, newlines and backslashes in values as \t, \n and \\. Empty
+fields are left out of json and yaml. Fields may be added, but will
+not be renamed or removed.
+
 more experimental than anything.
 
 Copyright 2019 Simon Symeonidis (psyomn)
@@ -27,18 +65,16 @@ limitations under the License.
 package memo
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/psyomn/psy/common"
 )
@@ -46,182 +82,364 @@ import (
 func memoDirPath() string      { return path.Join(common.ConfigDir(), "memo") }
 func memoDataFilePath() string { return path.Join(memoDirPath(), "data.gobbin") }
 
-type memoRecord struct {
-	Id   uint64
-	Data string
-}
-type memoStore struct {
-	Data map[string]*memoRecord
+func usage(fs *flag.FlagSet) error {
+	fs.Usage()
+	return errors.New("wrong usage")
 }
 
-func memoStoreNew() *memoStore {
-	var store memoStore
-	store.Data = make(map[string]*memoRecord)
-	return &store
-}
+// Run the memo command. It is a command line over Store, and the few
+// things that are only useful from a terminal.
+func Run(args common.RunParams) common.RunReturn {
+	type memoFlags struct {
+		fileName  string
+		memo      string
+		list      bool
+		search    string
+		del       bool
+		check     bool
+		prune     bool
+		relink    bool
+		root      string
+		backend   string
+		sync      bool
+		recursive bool
+		tree      bool
+		export    string
+		importer  string
+		home      string
+		conflict  string
+		init      bool
+		global    bool
+		subject   string
+		audit     bool
+		watch     string
+		unwatch   string
+		execOnly  bool
+		shellHook string
+		capture   string
+		since     int64
+		review    string
+		ttl       string
+		due       bool
+		within    string
+		archive   bool
+		archived  bool
+		encrypt   bool
+		decrypt   bool
+		rekey     bool
+		unlock    bool
+		lock      bool
+		format    string
+	}
+
+	sess := memoFlags{}
+
+	memoCmd := flag.NewFlagSet("memo", flag.ExitOnError)
+	memoCmd.StringVar(&sess.fileName, "file", sess.fileName, "<message> - the filename to write a memo about")
+	memoCmd.BoolVar(&sess.list, "list", sess.list, "[dir] - list all current memos, or the ones in dir")
+	memoCmd.BoolVar(&sess.recursive, "recursive", sess.recursive, "with -list <dir> or -watch, include subdirectories")
+	memoCmd.BoolVar(&sess.tree, "tree", sess.tree, "with -list, render the directory as a tree, showing files without memos")
+	memoCmd.StringVar(&sess.search, "search", sess.search, "<query> - search memo text and paths; supports \"phrases\" and prefix*")
+	memoCmd.BoolVar(&sess.del, "delete", sess.del, "delete the memo of the given -file or -subject")
+	memoCmd.BoolVar(&sess.check, "check", sess.check, "report memos of missing, changed or moved files")
+	memoCmd.BoolVar(&sess.prune, "prune", sess.prune, "delete memos of missing files that could not be found elsewhere")
+	memoCmd.BoolVar(&sess.relink, "relink", sess.relink, "move memos of missing files onto where they were found")
+	memoCmd.StringVar(&sess.root, "root", sess.root, "<dir> - recursively look for moved files here, instead of next to where they were")
+	memoCmd.StringVar(&sess.backend, "backend", "store", "<store|xattr> - where memos are written; xattr keeps them on the file too")
+	memoCmd.BoolVar(&sess.sync, "sync", sess.sync, "[dirs...] - reconcile memos kept on files with the store, importing any found under dirs")
+	memoCmd.StringVar(&sess.export, "export", sess.export, "<json|csv|md> - write all memos to stdout")
+	memoCmd.StringVar(&sess.importer, "import", sess.importer, "<file> - merge an exported store (.json, .csv or .md) into this one")
+	memoCmd.StringVar(&sess.home, "remote-home", sess.home, "<dir> - with -import, the home directory paths are remapped from (json exports carry it)")
+	memoCmd.StringVar(&sess.conflict, "conflict", string(conflictNewer), "<newer|local|remote|ask> - with -import, which memo to keep when both have one")
+	memoCmd.BoolVar(&sess.init, "init", sess.init, "create a "+projectStoreName+" project store in the current directory")
+	memoCmd.BoolVar(&sess.global, "global", sess.global, "use the global store even for files in a project")
+	memoCmd.StringVar(&sess.subject, "subject", sess.subject, "<"+kindsString()+">:<value> <message> - write a memo about something that is not (just) a file")
+	memoCmd.BoolVar(&sess.audit, "audit", sess.audit, "report files without memos in watched directories; fails if there are any")
+	memoCmd.StringVar(&sess.watch, "watch", sess.watch, "<dir> - add a directory to audit; see -executables and -recursive")
+	memoCmd.StringVar(&sess.unwatch, "unwatch", sess.unwatch, "<dir> - stop auditing a directory")
+	memoCmd.BoolVar(&sess.execOnly, "executables", sess.execOnly, "with -watch, only audit executable files")
+	memoCmd.StringVar(&sess.shellHook, "shell-hook", sess.shellHook, "<bash|zsh|fish> - print a snippet offering memos for files commands put in watched directories")
+	memoCmd.StringVar(&sess.capture, "capture", sess.capture, "<command> - used by the shell hook, after a command ran")
+	memoCmd.Int64Var(&sess.since, "since", sess.since, "<unix time> - with -capture, when the command started")
+	memoCmd.StringVar(&sess.review, "review", sess.review, "<date|duration> - when writing, look at the memo again by then; eg: 2020-12-31 or 30d")
+	memoCmd.StringVar(&sess.ttl, "ttl", sess.ttl, "<date|duration> - when writing, the memo expires then, and can be archived")
+	memoCmd.BoolVar(&sess.due, "due", sess.due, "list memos due for review or expired")
+	memoCmd.StringVar(&sess.within, "within", "0d", "<duration> - with -due, also list the ones due within this long; eg: 7d")
+	memoCmd.BoolVar(&sess.archive, "archive", sess.archive, "move expired memos to the archive")
+	memoCmd.BoolVar(&sess.archived, "archived", sess.archived, "with -list, list the archive instead")
+	memoCmd.BoolVar(&sess.encrypt, "encrypt", sess.encrypt, "encrypt the global store with a passphrase ("+passphraseEnv+", or asked for); project stores, the capture log and audit state stay in the clear")
+	memoCmd.BoolVar(&sess.decrypt, "decrypt", sess.decrypt, "write the store in the clear again")
+	memoCmd.BoolVar(&sess.rekey, "rekey", sess.rekey, "change the passphrase of the store (the new one from "+newPassphraseEnv+", or asked for)")
+	memoCmd.StringVar(&sess.format, "format", string(formatText), "<text|json|yaml|tsv> - how reading, -list, -search and -due print memos")
+	memoCmd.BoolVar(&sess.unlock, "unlock", sess.unlock, "start a session for the shell; eval $(psy memo -unlock) to be asked once")
+	memoCmd.BoolVar(&sess.lock, "lock", sess.lock, "end every session started with -unlock")
+	memoCmd.Parse(args)
 
-func init() {
-	if _, err := os.Stat(memoDirPath()); os.IsNotExist(err) {
-		os.MkdirAll(memoDirPath(), os.ModePerm)
+	if err := os.MkdirAll(memoDirPath(), os.ModePerm); err != nil {
+		return err
 	}
 
-	if _, err := os.Stat(memoDataFilePath()); os.IsNotExist(err) {
-		initStore := memoStoreNew()
-		store(initStore)
+	format, err := parseFormat(sess.format)
+	if err != nil {
+		return err
 	}
-}
 
-func (s *memoStore) encode() (bytes.Buffer, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
+	if sess.encrypt || sess.decrypt || sess.rekey {
+		return encryptStore(!sess.decrypt, sess.rekey)
+	}
 
-	err := enc.Encode(*s)
-	if err != nil {
-		log.Println("problem encoding memo store file: ", err)
+	if sess.unlock {
+		return unlock()
 	}
 
-	return buffer, err
-}
+	if sess.lock {
+		return lock()
+	}
 
-func (s *memoStore) Add(key, value string) {
-	maxID := s.maxID() + 1
-	s.Data[key] = &memoRecord{Id: maxID, Data: value}
-}
+	if conf, err := loadConfig(); err == nil && conf.AutoArchive && !sess.archive {
+		if err := archiveExpired(false); err != nil {
+			return err
+		}
+	}
 
-func (s *memoStore) Get(key string) (*memoRecord, bool) {
-	val, ok := s.Data[key]
-	return val, ok
-}
+	if sess.list && sess.archived {
+		return listArchived(format)
+	}
 
-func (s *memoStore) maxID() uint64 {
-	var maxID uint64
-	for _, v := range s.Data {
-		if maxID < v.Id {
-			maxID = v.Id
+	if sess.list {
+		dir := ""
+		if len(memoCmd.Args()) > 0 {
+			dir = memoCmd.Args()[0]
+		}
+		stores, err := visibleStores()
+		if err != nil {
+			return err
 		}
+		return list(stores, dir, sess.recursive, sess.tree, format)
 	}
 
-	return maxID
-}
+	if sess.due {
+		now := time.Now()
+		horizon, err := parseWhen(sess.within, now)
+		if err != nil {
+			return err
+		}
+		return listDue(horizon.Sub(now), format)
+	}
 
-func decode(cmdInFile string) *memoStore {
-	var buff bytes.Buffer
+	if sess.archive {
+		return archiveExpired(true)
+	}
 
-	if !common.FileExists(cmdInFile) {
-		return memoStoreNew()
+	if sess.shellHook != "" {
+		return shellHook(sess.shellHook)
 	}
 
-	dat, err := ioutil.ReadFile(cmdInFile)
-	if err != nil {
-		log.Fatal("problem opening file:", cmdInFile, ":", err)
-		os.Exit(1)
+	if sess.capture != "" {
+		return capture(sess.capture, sess.since)
 	}
 
-	dec := gob.NewDecoder(&buff)
-	var store memoStore
-	buff.Write(dat)
+	if sess.audit {
+		return audit()
+	}
 
-	err = dec.Decode(&store)
-	if err != nil {
-		log.Println("problem decoding store: ", cmdInFile, ", ", err)
-		os.Exit(1)
+	if sess.watch != "" {
+		return watch(sess.watch, sess.execOnly, sess.recursive)
 	}
 
-	return &store
-}
+	if sess.unwatch != "" {
+		return unwatch(sess.unwatch)
+	}
 
-func mkconfig() {
-	memodir := memoDirPath()
-	mkdirError := os.MkdirAll(memodir, os.ModePerm)
-	if mkdirError != nil {
-		log.Println("problem creating memo dir directories")
+	if sess.export != "" {
+		theStore, err := openGlobal()
+		if err != nil {
+			return err
+		}
+		return writeExport(os.Stdout, exportStore(theStore.memos), sess.export)
 	}
-}
 
-func store(memos *memoStore) {
-	bytes, err := memos.encode()
+	if sess.importer != "" {
+		return importFile(sess.importer, sess.home, sess.conflict)
+	}
 
-	file, err := os.Create(memoDataFilePath())
-	if err != nil {
-		log.Println("problem opening file for storing gob: ", err)
-		return
+	if sess.search != "" {
+		return search(sess.search, format)
 	}
-	defer file.Close()
 
-	_, err = file.Write(bytes.Bytes())
-	if err != nil {
-		log.Println("problem writing memo file")
-		return
+	if sess.check || sess.prune || sess.relink {
+		return check(sess.root, sess.prune, sess.relink)
 	}
-}
 
-func usage(fs *flag.FlagSet) error {
-	fs.Usage()
-	return errors.New("wrong usage")
-}
+	if sess.sync {
+		return syncXattrs(memoCmd.Args(), sess.backend == "xattr")
+	}
 
-// Run the memo command
-// TODO: this needs some cleaning up and a better argument parsing strategy
-func Run(args common.RunParams) common.RunReturn {
-	type memoFlags struct {
-		fileName string
-		memo     string
-		list     bool
+	if sess.init {
+		return initProject()
 	}
 
-	sess := memoFlags{}
+	subj := subject{kindFile, sess.fileName}
+	if sess.subject != "" {
+		var err error
+		if subj, err = parseSubject(sess.subject); err != nil {
+			return err
+		}
+	}
 
-	memoCmd := flag.NewFlagSet("memo", flag.ExitOnError)
-	memoCmd.StringVar(&sess.fileName, "file", sess.fileName, "<message> - the filename to write a memo about")
-	memoCmd.BoolVar(&sess.list, "list", sess.list, "list all current memos")
-	memoCmd.Parse(args)
+	if subj.value == "" {
+		return usage(memoCmd)
+	}
 
-	if sess.list {
-		theStore := decode(memoDataFilePath())
+	// memos of files that are gone can still be deleted
+	key, err := subj.key(!sess.del)
+	if err != nil {
+		return err
+	}
+
+	backend, err := backendFor(sess.backend, key, sess.global)
+	if err != nil {
+		return err
+	}
+
+	if sess.del {
+		if err := backend.Delete(key); err != nil {
+			return err
+		}
+		return backend.Close()
+	}
 
-		writer := new(tabwriter.Writer)
-		writer.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	if len(memoCmd.Args()) > 0 || sess.review != "" || sess.ttl != "" {
+		if len(memoCmd.Args()) > 0 {
+			message := strings.Join(memoCmd.Args(), " ")
+			if _, err := backend.Put(key, message); err != nil {
+				return err
+			}
+		}
 
-		for k, v := range theStore.Data {
-			fmt.Fprintf(writer, "%v\t%v\t%v\n", v.Id, k, v.Data)
+		if sess.review != "" || sess.ttl != "" {
+			if err := schedule(backend, key, sess.review, sess.ttl); err != nil {
+				return err
+			}
 		}
 
-		writer.Flush()
+		return backend.Close()
+	}
 
+	// read operations
+	storeName := "global"
+	value, err := backend.Get(key)
+	if _, isProject := backend.(*projectStore); isProject {
+		storeName = "project"
+		if err == ErrNotFound {
+			global, gerr := openBackend(sess.backend)
+			if gerr != nil {
+				return gerr
+			}
+			storeName = "global"
+			value, err = global.Get(key)
+		}
+	}
+	if err == ErrNotFound {
+		log.Println("could not find entry for:", subj.value)
 		return nil
 	}
+	if err != nil {
+		return err
+	}
 
-	if _, err := os.Stat(sess.fileName); os.IsNotExist(err) {
-		return errors.New("fool! you can't memo what does not exist")
+	if format != formatText {
+		return writeOutput(os.Stdout, format, []memoOutput{outputOf(key, value, storeName)}, true)
 	}
 
-	if sess.fileName == "" {
-		return nil
+	fmt.Println(value.Data)
+
+	return nil
+}
+
+func search(query string, format outputFormat) error {
+	clauses := parseQuery(query)
+	if len(clauses) == 0 {
+		return errors.New("nothing to search for")
 	}
 
-	absPath, err := filepath.Abs(sess.fileName)
+	stores, err := visibleStores()
 	if err != nil {
-		log.Println("problem getting abs path:", err)
-		return nil
+		return err
 	}
 
-	if len(memoCmd.Args()) > 0 {
-		message := strings.Join(memoCmd.Args(), " ")
-		theStore := decode(memoDataFilePath())
-		theStore.Add(absPath, message)
-		store(theStore)
-		return nil
+	// only the global store keeps its index around; project stores
+	// are small, and the index has no business being committed.
+	found := make(map[string]*Record)
+	foundIn := make(map[string]string)
+	var hits []searchHit
+	for _, s := range stores {
+		ix := buildIndex(s.memos)
+		if s.store != nil {
+			if ix, err = loadIndex(s.store); err != nil {
+				return err
+			}
+		}
+
+		for _, hit := range ix.search(clauses) {
+			if _, dup := found[hit.key]; dup {
+				continue
+			}
+			found[hit.key] = s.memos.Data[hit.key]
+			foundIn[hit.key] = s.name
+			hits = append(hits, hit)
+		}
 	}
 
-	// read operations
-	store := decode(memoDataFilePath())
-	value, ok := store.Get(absPath)
-	if !ok {
-		log.Println("could not find entry for:", sess.fileName)
-		return nil
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+
+	if format != formatText {
+		var memos []memoOutput
+		for _, hit := range hits {
+			m := outputOf(hit.key, found[hit.key], foundIn[hit.key])
+			m.Score = hit.score
+			memos = append(memos, m)
+		}
+		return writeOutput(os.Stdout, format, memos, false)
 	}
 
-	fmt.Println(value)
+	hl := newHighlighter()
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 1, '\t', 0)
 
-	return nil
+	for _, hit := range hits {
+		rec := found[hit.key]
+		fmt.Fprintf(writer, "%v\t%v\t%v\n",
+			shownID(rec, foundIn[hit.key]),
+			hl.mark(hit.key, tokenize(hit.key), 0, hit.matched),
+			hl.snippet(hit.key, rec.Data, hit.matched))
+	}
+
+	return writer.Flush()
+}
+
+// schedule sets the review and expiry dates that were given, and
+// keeps the ones that were not.
+func schedule(backend memoBackend, key, review, ttl string) error {
+	rec, err := backend.Get(key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	reviewBy, expires := rec.ReviewBy, rec.Expires
+
+	if review != "" {
+		if reviewBy, err = parseWhen(review, now); err != nil {
+			return err
+		}
+	}
+
+	if ttl != "" {
+		if expires, err = parseWhen(ttl, now); err != nil {
+			return err
+		}
+	}
+
+	return backend.Schedule(key, reviewBy, expires)
 }
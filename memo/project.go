@@ -0,0 +1,229 @@
+package memo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// projectStoreName is looked for in the current directory and its
+// parents, the same way git finds .git. It is json with paths relative
+// to the directory it is in, so that it can be committed and shared.
+const projectStoreName = ".psy-memo"
+
+type projectStore struct {
+	path  string
+	root  string
+	memos *memoStore
+}
+
+func findProject(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+
+	for {
+		candidate := filepath.Join(dir, projectStoreName)
+		if fi, err := os.Stat(candidate); err == nil && fi.Mode().IsRegular() {
+			return candidate, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// openProject returns the project store for the current directory, or
+// nil if there is none.
+func openProject() (*projectStore, error) {
+	path, ok := findProject(".")
+	if !ok {
+		return nil, nil
+	}
+
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var exported exportedStore
+	if len(strings.TrimSpace(string(dat))) > 0 {
+		if err := json.Unmarshal(dat, &exported); err != nil {
+			return nil, fmt.Errorf("problem decoding project store %v: %v", path, err)
+		}
+	}
+
+	p := &projectStore{path: path, root: filepath.Dir(path), memos: memoStoreNew()}
+	for _, m := range exported.Memos {
+		p.memos.Data[filepath.Join(p.root, filepath.FromSlash(m.Path))] = m.record()
+	}
+	if len(exported.Archive) > 0 {
+		p.memos.Archive = make(map[string]*Record)
+	}
+	for _, m := range exported.Archive {
+		rec := m.record()
+		p.memos.Archive[archiveKey(filepath.Join(p.root, filepath.FromSlash(m.Path)), rec)] = rec
+	}
+
+	return p, nil
+}
+
+func initProject() error {
+	if _, err := os.Stat(projectStoreName); err == nil {
+		return fmt.Errorf("%v already exists", projectStoreName)
+	}
+
+	root, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
+
+	p := &projectStore{path: projectStoreName, root: root, memos: memoStoreNew()}
+	return p.save()
+}
+
+func (p *projectStore) contains(absPath string) bool {
+	return inDir(absPath, p.root, true)
+}
+
+func (p *projectStore) save() error {
+	exported := exportStore(p.memos)
+	exported.Home = ""
+	if exported.Memos == nil {
+		exported.Memos = []exportedMemo{}
+	}
+
+	for _, e := range p.memos.archived() {
+		exported.Archive = append(exported.Archive, exportedMemoOf(e.Key, e.Record))
+	}
+
+	for _, memos := range [][]exportedMemo{exported.Memos, exported.Archive} {
+		for i := range memos {
+			rel, err := filepath.Rel(p.root, memos[i].Path)
+			if err != nil {
+				return err
+			}
+			memos[i].Path = filepath.ToSlash(rel)
+		}
+	}
+
+	dat, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p.path, append(dat, '\n'), 0644)
+}
+
+func (p *projectStore) Get(key string) (*Record, error) {
+	rec, ok := p.memos.get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return rec, nil
+}
+
+func (p *projectStore) Put(key, text string) (*Record, error) {
+	if !p.contains(key) {
+		return nil, fmt.Errorf("%v is not in the project at %v", key, p.root)
+	}
+
+	rec := p.memos.add(key, text)
+	fingerprint(key, rec)
+	return rec, nil
+}
+
+func (p *projectStore) Delete(key string) error {
+	if !p.memos.remove(key) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *projectStore) Schedule(key string, reviewBy, expires time.Time) error {
+	return p.memos.schedule(key, reviewBy, expires)
+}
+
+func (p *projectStore) Close() error {
+	if len(p.memos.changed) == 0 {
+		return nil
+	}
+	p.memos.changed = nil
+	return p.save()
+}
+
+// shownID is the id of a memo in text listings. Project memos are
+// numbered apart from the global ones, so theirs carry a p.
+func shownID(rec *Record, store string) string {
+	if store == "project" {
+		return fmt.Sprintf("p%v", rec.Id)
+	}
+	return fmt.Sprintf("%v", rec.Id)
+}
+
+// namedStore is a store along with where it came from, for listings
+// that show memos of more than one store. Only the global one has a
+// Store; the project one is not worth indexing.
+type namedStore struct {
+	name    string
+	memos   *memoStore
+	store   *Store
+	project *projectStore
+}
+
+// save writes back whatever was changed in the store.
+func (s namedStore) save() error {
+	if s.store != nil {
+		return s.store.Close()
+	}
+	return s.project.Close()
+}
+
+// visibleStores are the stores memos are read from, in order of
+// precedence.
+func visibleStores() ([]namedStore, error) {
+	var stores []namedStore
+
+	project, err := openProject()
+	if err != nil {
+		return nil, err
+	}
+	if project != nil {
+		stores = append(stores, namedStore{"project", project.memos, nil, project})
+	}
+
+	global, err := openGlobal()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(stores, namedStore{"global", global.memos, global, nil}), nil
+}
+
+// backendFor picks the project store for files that are in the
+// project, unless asked for the global one.
+func backendFor(name, absPath string, global bool) (memoBackend, error) {
+	if err := checkBackend(name); err != nil {
+		return nil, err
+	}
+
+	if !global {
+		project, err := openProject()
+		if err != nil {
+			return nil, err
+		}
+		if project != nil && project.contains(absPath) {
+			return through(name, project), nil
+		}
+	}
+
+	return openBackend(name)
+}
@@ -0,0 +1,148 @@
+package memo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// This is scrypt (RFC 7914), written out here to keep psy free of
+// dependencies outside of the standard library.
+
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var counter [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
+
+// salsaXOR applies salsa20/8 to tmp xor in, leaving the result in both
+// out and tmp.
+func salsaXOR(tmp *[16]uint32, in, out []uint32) {
+	var w [16]uint32
+	for i := range w {
+		w[i] = tmp[i] ^ in[i]
+	}
+
+	x := w
+	qr := func(a, b, c, d int) {
+		x[b] ^= bits.RotateLeft32(x[a]+x[d], 7)
+		x[c] ^= bits.RotateLeft32(x[b]+x[a], 9)
+		x[d] ^= bits.RotateLeft32(x[c]+x[b], 13)
+		x[a] ^= bits.RotateLeft32(x[d]+x[c], 18)
+	}
+
+	for i := 0; i < 8; i += 2 {
+		qr(0, 4, 8, 12)
+		qr(5, 9, 13, 1)
+		qr(10, 14, 2, 6)
+		qr(15, 3, 7, 11)
+
+		qr(0, 1, 2, 3)
+		qr(5, 6, 7, 4)
+		qr(10, 11, 8, 9)
+		qr(15, 12, 13, 14)
+	}
+
+	for i := range x {
+		x[i] += w[i]
+		out[i] = x[i]
+		tmp[i] = x[i]
+	}
+}
+
+func blockMix(tmp *[16]uint32, in, out []uint32, r int) {
+	copy(tmp[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i += 2 {
+		salsaXOR(tmp, in[i*16:], out[i*8:])
+		salsaXOR(tmp, in[i*16+16:], out[i*8+r*16:])
+	}
+}
+
+func integerify(b []uint32, r int) uint64 {
+	j := (2*r - 1) * 16
+	return uint64(b[j]) | uint64(b[j+1])<<32
+}
+
+func smix(b []byte, r, n int, v, xy []uint32) {
+	var tmp [16]uint32
+	size := 32 * r
+	x := xy
+	y := xy[size:]
+
+	for i := 0; i < size; i++ {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+
+	for i := 0; i < n; i += 2 {
+		copy(v[i*size:], x[:size])
+		blockMix(&tmp, x, y, r)
+		copy(v[(i+1)*size:], y[:size])
+		blockMix(&tmp, y, x, r)
+	}
+
+	for i := 0; i < n; i += 2 {
+		j := int(integerify(x, r) & uint64(n-1))
+		for k, w := range v[j*size : (j+1)*size] {
+			x[k] ^= w
+		}
+		blockMix(&tmp, x, y, r)
+
+		j = int(integerify(y, r) & uint64(n-1))
+		for k, w := range v[j*size : (j+1)*size] {
+			y[k] ^= w
+		}
+		blockMix(&tmp, y, x, r)
+	}
+
+	for i := 0; i < size; i++ {
+		binary.LittleEndian.PutUint32(b[i*4:], x[i])
+	}
+}
+
+// scryptKey derives a key of keyLen bytes. n must be a power of two.
+func scryptKey(password, salt []byte, n, r, p, keyLen int) ([]byte, error) {
+	if n <= 1 || n&(n-1) != 0 {
+		return nil, errors.New("scrypt: n must be a power of two greater than one")
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 || r > (1<<31-1)/128/p || n > (1<<31-1)/128/r {
+		return nil, errors.New("scrypt: parameters are too large")
+	}
+
+	b := pbkdf2SHA256(password, salt, 1, p*128*r)
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*n*r)
+
+	for i := 0; i < p; i++ {
+		smix(b[i*128*r:], r, n, v, xy)
+	}
+
+	return pbkdf2SHA256(password, b, 1, keyLen), nil
+}
@@ -0,0 +1,470 @@
+package memo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// token is a lowercased word, and where it was found in the original
+// text so that we can highlight it later.
+type token struct {
+	term       string
+	start, end int
+}
+
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		if start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+
+	return tokens
+}
+
+// documentTerms lays out the path components first, then the memo
+// text. A gap is left between the two so that a phrase can not match
+// across them.
+func documentTerms(key, text string) []string {
+	var terms []string
+	for _, tok := range tokenize(key) {
+		terms = append(terms, tok.term)
+	}
+
+	terms = append(terms, "")
+
+	for _, tok := range tokenize(text) {
+		terms = append(terms, tok.term)
+	}
+
+	return terms
+}
+
+type indexedDoc struct {
+	Id     uint64
+	Length int
+	Terms  []string
+}
+
+// searchIndex is an inverted index over the memos: every term points
+// to the memos it appears in, and the positions it appears at.
+type searchIndex struct {
+	Terms map[string]map[string][]int
+	Docs  map[string]*indexedDoc
+}
+
+func searchIndexNew() *searchIndex {
+	return &searchIndex{
+		Terms: make(map[string]map[string][]int),
+		Docs:  make(map[string]*indexedDoc),
+	}
+}
+
+func buildIndex(memos *memoStore) *searchIndex {
+	ix := searchIndexNew()
+	for k, v := range memos.Data {
+		ix.add(k, v)
+	}
+	return ix
+}
+
+func (ix *searchIndex) add(key string, rec *Record) {
+	ix.remove(key)
+
+	doc := &indexedDoc{Id: rec.Id}
+	for pos, term := range documentTerms(key, rec.Data) {
+		if term == "" {
+			continue
+		}
+
+		postings, ok := ix.Terms[term]
+		if !ok {
+			postings = make(map[string][]int)
+			ix.Terms[term] = postings
+		}
+
+		if _, seen := postings[key]; !seen {
+			doc.Terms = append(doc.Terms, term)
+		}
+		postings[key] = append(postings[key], pos)
+		doc.Length++
+	}
+
+	ix.Docs[key] = doc
+}
+
+func (ix *searchIndex) remove(key string) {
+	doc, ok := ix.Docs[key]
+	if !ok {
+		return
+	}
+
+	for _, term := range doc.Terms {
+		delete(ix.Terms[term], key)
+		if len(ix.Terms[term]) == 0 {
+			delete(ix.Terms, term)
+		}
+	}
+
+	delete(ix.Docs, key)
+}
+
+// stale is true when the index does not describe the given store
+// anymore; eg: the data file was edited by an older psy.
+func (ix *searchIndex) stale(memos *memoStore) bool {
+	if len(ix.Docs) != len(memos.Data) {
+		return true
+	}
+
+	for k, v := range memos.Data {
+		doc, ok := ix.Docs[k]
+		if !ok || doc.Id != v.Id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ix *searchIndex) encode() (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(*ix)
+	return buffer, err
+}
+
+func decodeIndex(indexFile string) (*searchIndex, error) {
+	dat, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var ix searchIndex
+	if err := gob.NewDecoder(bytes.NewReader(dat)).Decode(&ix); err != nil {
+		return nil, err
+	}
+
+	return &ix, nil
+}
+
+// loadIndex reads the persisted index, and rebuilds it if it is
+// missing or out of date with the store. Encrypted stores only ever
+// have it in memory.
+func loadIndex(s *Store) (*searchIndex, error) {
+	if s.Encrypted() {
+		return buildIndex(s.memos), nil
+	}
+
+	ix, err := decodeIndex(s.indexPath())
+	if err == nil && !ix.stale(s.memos) {
+		return ix, nil
+	}
+
+	ix = buildIndex(s.memos)
+	return ix, storeIndex(s.indexPath(), ix)
+}
+
+// syncIndex applies the keys that changed in the store since it was
+// decoded onto the persisted index.
+func syncIndex(s *Store) error {
+	ix, err := decodeIndex(s.indexPath())
+	if err != nil {
+		ix = buildIndex(s.memos)
+	}
+
+	for key := range s.memos.changed {
+		if rec, ok := s.memos.Data[key]; ok {
+			ix.add(key, rec)
+		} else {
+			ix.remove(key)
+		}
+	}
+
+	if ix.stale(s.memos) {
+		ix = buildIndex(s.memos)
+	}
+
+	return storeIndex(s.indexPath(), ix)
+}
+
+func storeIndex(path string, ix *searchIndex) error {
+	buff, err := ix.encode()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, buff.Bytes())
+}
+
+// clause is one part of a query. A clause with many terms is a
+// phrase; prefix makes its last term match anything starting with it.
+type clause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseQuery understands words, "quoted phrases" and trailing
+// wildcards (eg: sat*).
+func parseQuery(query string) []clause {
+	var clauses []clause
+
+	push := func(text string) {
+		prefix := strings.HasSuffix(text, "*")
+		var terms []string
+		for _, tok := range tokenize(text) {
+			terms = append(terms, tok.term)
+		}
+		if len(terms) > 0 {
+			clauses = append(clauses, clause{terms: terms, prefix: prefix})
+		}
+	}
+
+	for {
+		open := strings.IndexByte(query, '"')
+		if open < 0 {
+			break
+		}
+
+		for _, word := range strings.Fields(query[:open]) {
+			push(word)
+		}
+
+		rest := query[open+1:]
+		end := strings.IndexByte(rest, '"')
+		if end < 0 {
+			end = len(rest)
+			query = ""
+		} else {
+			query = rest[end+1:]
+		}
+
+		push(rest[:end])
+	}
+
+	for _, word := range strings.Fields(query) {
+		push(word)
+	}
+
+	return clauses
+}
+
+func (ix *searchIndex) postings(term string, prefix bool) map[string][]int {
+	if !prefix {
+		return ix.Terms[term]
+	}
+
+	merged := make(map[string][]int)
+	for t, docs := range ix.Terms {
+		if !strings.HasPrefix(t, term) {
+			continue
+		}
+		for key, positions := range docs {
+			merged[key] = append(merged[key], positions...)
+		}
+	}
+
+	return merged
+}
+
+// match returns every memo the clause matches in, with the positions
+// each occurrence starts at.
+func (ix *searchIndex) match(c clause) map[string][]int {
+	hits := make(map[string][]int)
+	for key, positions := range ix.postings(c.terms[0], c.prefix && len(c.terms) == 1) {
+		hits[key] = positions
+	}
+
+	for i := 1; i < len(c.terms); i++ {
+		postings := ix.postings(c.terms[i], c.prefix && i == len(c.terms)-1)
+		next := make(map[string][]int)
+
+		for key, starts := range hits {
+			at := make(map[int]bool)
+			for _, pos := range postings[key] {
+				at[pos] = true
+			}
+
+			for _, start := range starts {
+				if at[start+i] {
+					next[key] = append(next[key], start)
+				}
+			}
+		}
+
+		hits = next
+	}
+
+	return hits
+}
+
+type searchHit struct {
+	key     string
+	score   float64
+	matched map[int]bool
+}
+
+// search ranks memos matching every clause with BM25.
+func (ix *searchIndex) search(clauses []clause) []searchHit {
+	const (
+		k1 = 1.2
+		b  = 0.75
+	)
+
+	if len(clauses) == 0 || len(ix.Docs) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, doc := range ix.Docs {
+		total += doc.Length
+	}
+	numDocs := float64(len(ix.Docs))
+	avgLength := float64(total) / numDocs
+
+	var found map[string]*searchHit
+	for _, c := range clauses {
+		matches := ix.match(c)
+		df := float64(len(matches))
+		idf := math.Log(1 + (numDocs-df+0.5)/(df+0.5))
+
+		next := make(map[string]*searchHit)
+		for key, starts := range matches {
+			hit, ok := found[key]
+			if found == nil {
+				hit = &searchHit{key: key, matched: make(map[int]bool)}
+			} else if !ok {
+				continue
+			}
+
+			tf := float64(len(starts))
+			norm := 1 - b + b*float64(ix.Docs[key].Length)/avgLength
+			hit.score += idf * tf * (k1 + 1) / (tf + k1*norm)
+
+			for _, start := range starts {
+				for i := range c.terms {
+					hit.matched[start+i] = true
+				}
+			}
+
+			next[key] = hit
+		}
+
+		found = next
+	}
+
+	hits := make([]searchHit, 0, len(found))
+	for _, hit := range found {
+		hits = append(hits, *hit)
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].key < hits[j].key
+	})
+
+	return hits
+}
+
+// highlighter wraps the matched words; ansi escapes on terminals, and
+// brackets everywhere else so that it still reads well piped.
+type highlighter struct{ open, close string }
+
+func newHighlighter() highlighter {
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return highlighter{"\x1b[1;31m", "\x1b[0m"}
+	}
+	return highlighter{"[", "]"}
+}
+
+// mark highlights the tokens of text whose document position is in
+// matched. offset is the document position of the first token.
+func (h highlighter) mark(text string, tokens []token, offset int, matched map[int]bool) string {
+	var sb strings.Builder
+	last := 0
+	for i, tok := range tokens {
+		if !matched[offset+i] {
+			continue
+		}
+		sb.WriteString(text[last:tok.start])
+		sb.WriteString(h.open)
+		sb.WriteString(text[tok.start:tok.end])
+		sb.WriteString(h.close)
+		last = tok.end
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
+}
+
+// snippet cuts a window of the memo text around the first match.
+func (h highlighter) snippet(key, text string, matched map[int]bool) string {
+	const (
+		before = 6
+		after  = 14
+	)
+
+	tokens := tokenize(text)
+	offset := len(tokenize(key)) + 1
+
+	first := 0
+	for i := range tokens {
+		if matched[offset+i] {
+			first = i
+			break
+		}
+	}
+
+	from := first - before
+	if from < 0 {
+		from = 0
+	}
+	to := first + after
+	if to > len(tokens) {
+		to = len(tokens)
+	}
+
+	if len(tokens) == 0 {
+		return text
+	}
+
+	start, end := 0, len(text)
+	prefix, suffix := "", ""
+	if from > 0 {
+		start = tokens[from].start
+		prefix = "..."
+	}
+	if to < len(tokens) {
+		end = tokens[to-1].end
+		suffix = "..."
+	}
+
+	window := tokens[from:to]
+	shifted := make([]token, len(window))
+	for i, tok := range window {
+		shifted[i] = token{tok.term, tok.start - start, tok.end - start}
+	}
+
+	body := h.mark(text[start:end], shifted, offset+from, matched)
+	return prefix + strings.Replace(body, "\n", " ", -1) + suffix
+}
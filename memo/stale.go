@@ -0,0 +1,242 @@
+package memo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fingerprint records what the file currently looks like onto the
+// memo.
+func fingerprint(path string, rec *Record) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	rec.Device, rec.Inode, _ = fileID(fi)
+	rec.Size = fi.Size()
+	rec.Hash = ""
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	rec.Hash, err = hashFile(path)
+	return err
+}
+
+type staleKind string
+
+const (
+	staleMissing staleKind = "missing"
+	staleChanged staleKind = "changed"
+	staleMoved   staleKind = "moved"
+)
+
+type staleMemo struct {
+	kind    staleKind
+	key     string
+	rec     *Record
+	newPath string
+}
+
+// findStale goes through the memos looking for files that are gone
+// or changed. Missing files are looked for under roots, or in the
+// directory they used to be in when there are no roots.
+func findStale(memos *memoStore, roots []string) []*staleMemo {
+	var stale []*staleMemo
+	var missing []*staleMemo
+
+	for k, v := range memos.Data {
+		if !isFileKey(k) {
+			continue
+		}
+
+		fi, err := os.Stat(k)
+		if os.IsNotExist(err) {
+			m := &staleMemo{kind: staleMissing, key: k, rec: v}
+			stale = append(stale, m)
+			missing = append(missing, m)
+			continue
+		}
+		if err != nil || v.Hash == "" || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if fi.Size() != v.Size {
+			stale = append(stale, &staleMemo{kind: staleChanged, key: k, rec: v})
+			continue
+		}
+
+		if hash, err := hashFile(k); err == nil && hash != v.Hash {
+			stale = append(stale, &staleMemo{kind: staleChanged, key: k, rec: v})
+		}
+	}
+
+	if len(missing) > 0 {
+		findMoved(memos, missing, roots)
+	}
+
+	sort.Slice(stale, func(i, j int) bool { return stale[i].key < stale[j].key })
+	return stale
+}
+
+func findMoved(memos *memoStore, missing []*staleMemo, roots []string) {
+	recursive := len(roots) > 0
+	if !recursive {
+		seen := make(map[string]bool)
+		for _, m := range missing {
+			dir := filepath.Dir(m.key)
+			if !seen[dir] {
+				seen[dir] = true
+				roots = append(roots, dir)
+			}
+		}
+	}
+
+	hashes := make(map[string]string)
+	visit := func(path string, fi os.FileInfo) {
+		if !fi.Mode().IsRegular() {
+			return
+		}
+		if _, ok := memos.Data[path]; ok {
+			return
+		}
+
+		dev, ino, hasID := fileID(fi)
+		for _, m := range missing {
+			if m.kind == staleMoved {
+				continue
+			}
+
+			sameFile := hasID && m.rec.Inode != 0 && dev == m.rec.Device && ino == m.rec.Inode
+			if !sameFile && (m.rec.Hash == "" || fi.Size() != m.rec.Size) {
+				continue
+			}
+
+			if !sameFile {
+				hash, ok := hashes[path]
+				if !ok {
+					hash, _ = hashFile(path)
+					hashes[path] = hash
+				}
+				if hash != m.rec.Hash {
+					continue
+				}
+			}
+
+			m.kind = staleMoved
+			m.newPath = path
+			return
+		}
+	}
+
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			log.Println("skipping search root:", err)
+			continue
+		}
+
+		if !recursive {
+			infos, err := readDir(root)
+			if err != nil {
+				continue
+			}
+			for _, fi := range infos {
+				visit(filepath.Join(root, fi.Name()), fi)
+			}
+			continue
+		}
+
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			visit(path, fi)
+			return nil
+		})
+	}
+}
+
+func readDir(dir string) ([]os.FileInfo, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return file.Readdir(-1)
+}
+
+// check reports stale memos, and prunes or relinks them if asked to.
+func check(root string, prune, relink bool) error {
+	var roots []string
+	if root != "" {
+		roots = append(roots, root)
+	}
+
+	stores, err := visibleStores()
+	if err != nil {
+		return err
+	}
+
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 1, '\t', 0)
+
+	for _, s := range stores {
+		for _, m := range findStale(s.memos, roots) {
+			switch {
+			case m.kind == staleMoved && relink && s.project != nil && !s.project.contains(m.newPath):
+				// the project store only has paths under the project
+				fmt.Fprintf(writer, "%v\t%v\t-> %v (outside the project, not relinked)\n", m.kind, m.key, m.newPath)
+			case m.kind == staleMoved && relink:
+				s.memos.move(m.key, m.newPath)
+				if err := fingerprint(m.newPath, m.rec); err != nil {
+					log.Println("could not fingerprint file:", err)
+				}
+				fmt.Fprintf(writer, "relinked\t%v\t-> %v\n", m.key, m.newPath)
+			case m.kind == staleMissing && prune:
+				s.memos.remove(m.key)
+				fmt.Fprintf(writer, "pruned\t%v\t\n", m.key)
+			case m.kind == staleMoved:
+				fmt.Fprintf(writer, "%v\t%v\t-> %v\n", m.kind, m.key, m.newPath)
+			default:
+				fmt.Fprintf(writer, "%v\t%v\t\n", m.kind, m.key)
+			}
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	for _, s := range stores {
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
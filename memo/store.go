@@ -0,0 +1,336 @@
+package memo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNotFound is returned when there is no memo for a key.
+var ErrNotFound = errors.New("memo: not found")
+
+// Record is a memo. Files are keyed by their absolute path, anything
+// else as kind:value (see Key).
+type Record struct {
+	Id   uint64
+	Data string
+
+	// What the file looked like when the memo was written, so that
+	// we can tell when it changes or moves somewhere else.
+	Device  uint64
+	Inode   uint64
+	Size    int64
+	Hash    string
+	Written time.Time
+
+	// Xattr is set when the memo is also written on the file itself.
+	Xattr bool
+
+	// ReviewBy is when the memo should be looked at again, and Expires
+	// when it can be archived; eg: "installed to test X, delete after
+	// the release".
+	ReviewBy time.Time
+	Expires  time.Time
+}
+
+// Entry is a memo along with the key it is stored under.
+type Entry struct {
+	Key    string
+	Record *Record
+}
+
+// memoStore is what goes in the data file.
+type memoStore struct {
+	Data map[string]*Record
+
+	// NextID is the last id handed out. Stores written before it
+	// existed have it at zero, and get it from a scan of the ids.
+	NextID uint64
+
+	// Archive has the expired memos, out of the way but not gone.
+	Archive map[string]*Record
+
+	// keys added, edited or deleted since the store was decoded, so
+	// that the search index can follow along.
+	changed map[string]bool
+}
+
+func memoStoreNew() *memoStore {
+	var store memoStore
+	store.Data = make(map[string]*Record)
+	return &store
+}
+
+// add writes value under key. Editing a memo keeps its id, schedule
+// and all; only the text and when it was written change.
+func (s *memoStore) add(key, value string) *Record {
+	if rec, ok := s.Data[key]; ok {
+		rec.Data = value
+		rec.Written = time.Now()
+		s.touch(key)
+		return rec
+	}
+
+	rec := &Record{Data: value, Written: time.Now()}
+	s.insert(key, rec)
+	return rec
+}
+
+// insert places the record under key with a fresh id.
+func (s *memoStore) insert(key string, rec *Record) {
+	rec.Id = s.nextID()
+	s.Data[key] = rec
+	s.touch(key)
+}
+
+func (s *memoStore) nextID() uint64 {
+	if s.NextID == 0 {
+		s.NextID = s.maxID()
+	}
+	s.NextID++
+	return s.NextID
+}
+
+func (s *memoStore) remove(key string) bool {
+	if _, ok := s.Data[key]; !ok {
+		return false
+	}
+
+	delete(s.Data, key)
+	s.touch(key)
+	return true
+}
+
+// move follows a file that was renamed to another path.
+func (s *memoStore) move(from, to string) bool {
+	rec, ok := s.Data[from]
+	if !ok {
+		return false
+	}
+
+	delete(s.Data, from)
+	s.Data[to] = rec
+	s.touch(from)
+	s.touch(to)
+	return true
+}
+
+func (s *memoStore) touch(key string) {
+	if s.changed == nil {
+		s.changed = make(map[string]bool)
+	}
+	s.changed[key] = true
+}
+
+func (s *memoStore) get(key string) (*Record, bool) {
+	val, ok := s.Data[key]
+	return val, ok
+}
+
+func (s *memoStore) maxID() uint64 {
+	var maxID uint64
+	for _, records := range []map[string]*Record{s.Data, s.Archive} {
+		for _, v := range records {
+			if maxID < v.Id {
+				maxID = v.Id
+			}
+		}
+	}
+
+	return maxID
+}
+
+func (s *memoStore) encode() (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(*s)
+	return buffer, err
+}
+
+func decode(dat []byte) (*memoStore, error) {
+	store := memoStoreNew()
+
+	// older psy could leave an empty file behind
+	if len(dat) == 0 {
+		return store, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(dat)).Decode(store); err != nil {
+		return nil, err
+	}
+
+	if store.Data == nil {
+		store.Data = make(map[string]*Record)
+	}
+
+	return store, nil
+}
+
+// Store is a memo store on disk. Changes stay in memory until Close.
+type Store struct {
+	path  string
+	memos *memoStore
+
+	// sealing is set for encrypted stores, and rewrite when it changed
+	// and the whole store needs writing again.
+	sealing *sealing
+	rewrite bool
+}
+
+// DefaultPath is where the memo command keeps its store.
+func DefaultPath() string { return memoDataFilePath() }
+
+// Open reads the store at path, starting an empty one if there is
+// nothing there yet. Encrypted stores give ErrLocked.
+func Open(path string) (*Store, error) {
+	dat, err := readStore(path)
+	if err == nil && isEncrypted(dat) {
+		return nil, ErrLocked
+	}
+	return openData(path, dat, err)
+}
+
+func readStore(path string) ([]byte, error) {
+	dat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return dat, err
+}
+
+func openData(path string, dat []byte, err error) (*Store, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	memos, err := decode(dat)
+	if err != nil {
+		return nil, fmt.Errorf("problem decoding store %v: %v", path, err)
+	}
+
+	return &Store{path: path, memos: memos}, nil
+}
+
+// Key turns a subject into the key its memo is stored under. Subjects
+// are file paths, or kind:value where kind is one of file, url, pkg,
+// cmd or key.
+func Key(subj string) (string, error) {
+	s, err := parseSubject(subj)
+	if err != nil {
+		s = subject{kindFile, subj}
+	}
+	return s.key(false)
+}
+
+// Get returns the memo stored under key.
+func (s *Store) Get(key string) (*Record, error) {
+	rec, ok := s.memos.get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return rec, nil
+}
+
+// Put writes a memo, replacing any previous one under key. Memos on
+// files remember what the file looked like, to notice it changing.
+func (s *Store) Put(key, text string) (*Record, error) {
+	if key == "" {
+		return nil, errors.New("memo: empty key")
+	}
+
+	rec := s.memos.add(key, text)
+	if isFileKey(key) {
+		// a memo without a fingerprint is still a memo
+		fingerprint(key, rec)
+	}
+
+	return rec, nil
+}
+
+// Delete removes the memo stored under key.
+func (s *Store) Delete(key string) error {
+	if !s.memos.remove(key) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List returns every memo, sorted by key.
+func (s *Store) List() ([]Entry, error) {
+	entries := make([]Entry, 0, len(s.memos.Data))
+	for _, k := range sortedKeys(s.memos, "", false) {
+		entries = append(entries, Entry{Key: k, Record: s.memos.Data[k]})
+	}
+	return entries, nil
+}
+
+// Close writes the store back if anything changed. The search index
+// is kept next to it, unless the store is encrypted.
+func (s *Store) Close() error {
+	if len(s.memos.changed) == 0 && !s.rewrite {
+		return nil
+	}
+
+	buff, err := s.memos.encode()
+	if err != nil {
+		return err
+	}
+
+	dat := buff.Bytes()
+	if s.sealing != nil {
+		if dat, err = s.sealing.seal(dat); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(s.path, dat); err != nil {
+		return err
+	}
+
+	if s.sealing != nil {
+		// an index on disk would give the memos away
+		err = os.Remove(s.indexPath())
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = syncIndex(s)
+	}
+
+	s.memos.changed = nil
+	s.rewrite = false
+	return err
+}
+
+func (s *Store) indexPath() string { return s.path + ".index" }
+
+// writeFileAtomic makes sure a crash halfway through does not leave a
+// truncated store behind.
+func writeFileAtomic(path string, dat []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
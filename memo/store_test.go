@@ -0,0 +1,217 @@
+package memo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "psy-memo-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "data.gobbin"), func() { os.RemoveAll(dir) }
+}
+
+func mustKey(t *testing.T, subj string) string {
+	key, err := Key(subj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	path, done := tempStore(t)
+	defer done()
+
+	file := filepath.Join(filepath.Dir(path), "notes.txt")
+	if err := ioutil.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memos := map[string]string{
+		mustKey(t, file):           "a file",
+		mustKey(t, "url:psy.io/x"): "a url",
+		mustKey(t, "key:gpg"):      "a key",
+	}
+	for k, v := range memos {
+		if _, err := s.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for k, v := range memos {
+		rec, err := s.Get(k)
+		if err != nil {
+			t.Errorf("get %v: %v", k, err)
+			continue
+		}
+		if rec.Data != v {
+			t.Errorf("get %v = %q, want %q", k, rec.Data, v)
+		}
+	}
+
+	rec, _ := s.Get(mustKey(t, file))
+	if rec.Size != 5 || rec.Hash == "" {
+		t.Errorf("file memo fingerprint: size %v, hash %q", rec.Size, rec.Hash)
+	}
+}
+
+func TestStoreEditKeepsID(t *testing.T) {
+	path, done := tempStore(t)
+	defer done()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.Put("key:a", "one")
+	s.Put("key:b", "other")
+	second, _ := s.Put("key:a", "two")
+
+	if second.Id != first.Id || second.Data != "two" {
+		t.Errorf("edit gave id %v and %q, want id %v and \"two\"", second.Id, second.Data, first.Id)
+	}
+}
+
+func TestStoreNotFound(t *testing.T) {
+	path, done := tempStore(t)
+	defer done()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("key:nope"); err != ErrNotFound {
+		t.Errorf("get: %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Delete("key:nope"); err != ErrNotFound {
+		t.Errorf("delete: %v, want %v", err, ErrNotFound)
+	}
+
+	s.Put("key:a", "there")
+	if err := s.Delete("key:a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("key:a"); err != ErrNotFound {
+		t.Errorf("get after delete: %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Delete("key:a"); err != ErrNotFound {
+		t.Errorf("delete twice: %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestStoreListOrder(t *testing.T) {
+	path, done := tempStore(t)
+	defer done()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"key:c", "key:a", "url:b", "key:b"} {
+		s.Put(k, k)
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"key:a", "key:b", "key:c", "url:b"}
+	if len(entries) != len(want) {
+		t.Fatalf("%v entries, want %v", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Key != want[i] || e.Record.Data != want[i] {
+			t.Errorf("entry %v: %v %q, want %v", i, e.Key, e.Record.Data, want[i])
+		}
+	}
+}
+
+func TestStoreEncrypted(t *testing.T) {
+	path, done := tempStore(t)
+	defer done()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("key:a", "secret")
+	if err := s.Encrypt([]byte("right")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path); err != ErrLocked {
+		t.Errorf("open: %v, want %v", err, ErrLocked)
+	}
+	if _, err := OpenEncrypted(path, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("wrong passphrase: %v, want %v", err, ErrWrongPassphrase)
+	}
+
+	s, err = OpenEncrypted(path, []byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := s.Get("key:a"); err != nil || rec.Data != "secret" {
+		t.Errorf("get: %v, %v", rec, err)
+	}
+
+	// tampering looks like a wrong passphrase
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat[len(dat)-1] ^= 1
+	if err := ioutil.WriteFile(path, dat, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEncrypted(path, []byte("right")); err != ErrWrongPassphrase {
+		t.Errorf("tampered: %v, want %v", err, ErrWrongPassphrase)
+	}
+}
+
+func TestParseSealingLimits(t *testing.T) {
+	sl, err := newSealing([]byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseSealing(sl.header()); err != nil {
+		t.Fatalf("the header written: %v", err)
+	}
+
+	costs := [][3]int{
+		{maxScryptLogN + 1, scryptR, scryptP},
+		{30, scryptR, scryptP},
+		{scryptLogN, maxScryptR + 1, scryptP},
+		{scryptLogN, 255, 255},
+		{scryptLogN, 0, scryptP},
+		{scryptLogN, scryptR, 0},
+	}
+	for _, c := range costs {
+		bad := *sl
+		bad.logN, bad.r, bad.p = c[0], c[1], c[2]
+		if _, _, err := parseSealing(bad.header()); err == nil {
+			t.Errorf("N=2^%v r=%v p=%v was let through", c[0], c[1], c[2])
+		}
+	}
+}
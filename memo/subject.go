@@ -0,0 +1,136 @@
+package memo
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// subjectKind is what a memo is about. Files are keyed by their
+// absolute path like they always were; everything else is keyed as
+// kind:value.
+type subjectKind string
+
+const (
+	kindFile subjectKind = "file"
+	kindURL  subjectKind = "url"
+	kindPkg  subjectKind = "pkg"
+	kindCmd  subjectKind = "cmd"
+	kindKey  subjectKind = "key"
+)
+
+var subjectKinds = []subjectKind{kindFile, kindURL, kindPkg, kindCmd, kindKey}
+
+type subject struct {
+	kind  subjectKind
+	value string
+}
+
+// parseSubject reads things like url:https://psyomn.com or
+// pkg:apt/ripgrep.
+func parseSubject(s string) (subject, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		for _, kind := range subjectKinds {
+			if parts[0] == string(kind) {
+				return subject{kind, parts[1]}, nil
+			}
+		}
+	}
+
+	return subject{}, fmt.Errorf("subject should look like <%v>:<value>, got: %v", kindsString(), s)
+}
+
+func kindsString() string {
+	var kinds []string
+	for _, kind := range subjectKinds {
+		kinds = append(kinds, string(kind))
+	}
+	return strings.Join(kinds, "|")
+}
+
+// subjectOf recovers the subject from a store key.
+func subjectOf(key string) subject {
+	if filepath.IsAbs(key) {
+		return subject{kindFile, key}
+	}
+
+	if s, err := parseSubject(key); err == nil && s.kind != kindFile {
+		return s
+	}
+
+	return subject{kindKey, key}
+}
+
+func isFileKey(key string) bool { return subjectOf(key).kind == kindFile }
+
+var pkgName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._@:/-]*$`)
+
+// key validates and normalises the subject into the key it is stored
+// under. Files only need to exist when mustExist is set, so that the
+// memos of deleted files can still be removed.
+func (s subject) key(mustExist bool) (string, error) {
+	value := strings.TrimSpace(s.value)
+	if value == "" {
+		return "", fmt.Errorf("empty %v subject", s.kind)
+	}
+
+	switch s.kind {
+	case kindFile:
+		if _, err := os.Stat(value); os.IsNotExist(err) && mustExist {
+			return "", errors.New("fool! you can't memo what does not exist")
+		}
+		return filepath.Abs(value)
+
+	case kindURL:
+		if !strings.Contains(value, "://") {
+			value = "https://" + value
+		}
+
+		u, err := url.Parse(value)
+		if err != nil {
+			return "", err
+		}
+		if u.Host == "" {
+			return "", fmt.Errorf("url has no host: %v", s.value)
+		}
+
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) ||
+			(u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+			u.Host = u.Host[:strings.LastIndexByte(u.Host, ':')]
+		}
+		if u.Path == "/" {
+			u.Path = ""
+		}
+		u.Fragment = ""
+
+		return string(kindURL) + ":" + u.String(), nil
+
+	case kindPkg:
+		// pkg:name, or pkg:manager/name to tell apt from pip
+		if !pkgName.MatchString(value) {
+			return "", fmt.Errorf("not a package name: %v", s.value)
+		}
+		if i := strings.IndexByte(value, '/'); i > 0 {
+			value = strings.ToLower(value[:i]) + value[i:]
+		}
+		return string(kindPkg) + ":" + value, nil
+
+	case kindCmd:
+		return string(kindCmd) + ":" + strings.Join(strings.Fields(value), " "), nil
+
+	case kindKey:
+		if strings.ContainsAny(value, "\n\r") {
+			return "", errors.New("key subjects should be on a single line")
+		}
+		return string(kindKey) + ":" + value, nil
+	}
+
+	return "", fmt.Errorf("unknown subject kind: %v", s.kind)
+}
@@ -0,0 +1,47 @@
+package memo
+
+import "syscall"
+
+const memoXattr = "user.psy.memo"
+
+// xattrError tells a filesystem without attributes apart from the
+// rest. Permission errors are the user's to know about, not a reason
+// to quietly fall back to the store.
+func xattrError(err error) error {
+	switch err {
+	case syscall.ENOTSUP, syscall.EROFS:
+		return errXattrUnsupported
+	}
+	return err
+}
+
+// getXattr reads the memo off of a file, if there is one.
+func getXattr(path string) (string, bool, error) {
+	size, err := syscall.Getxattr(path, memoXattr, nil)
+	if err == syscall.ENODATA {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, xattrError(err)
+	}
+
+	buff := make([]byte, size)
+	size, err = syscall.Getxattr(path, memoXattr, buff)
+	if err != nil {
+		return "", false, xattrError(err)
+	}
+
+	return string(buff[:size]), true, nil
+}
+
+func setXattr(path, text string) error {
+	return xattrError(syscall.Setxattr(path, memoXattr, []byte(text), 0))
+}
+
+func removeXattr(path string) error {
+	err := syscall.Removexattr(path, memoXattr)
+	if err == syscall.ENODATA {
+		return nil
+	}
+	return xattrError(err)
+}
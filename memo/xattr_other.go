@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package memo
+
+func getXattr(path string) (string, bool, error) { return "", false, errXattrUnsupported }
+func setXattr(path, text string) error           { return errXattrUnsupported }
+func removeXattr(path string) error              { return errXattrUnsupported }
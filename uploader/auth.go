@@ -0,0 +1,142 @@
+package uploader
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// the token can come in any of these; the cookie is set once a
+	// browser got it right, so that it is typed in once.
+	tokenHeader = "X-Psy-Token"
+	tokenField  = "token"
+	tokenCookie = "psy-token"
+
+	tokenLength = 8
+
+	// this many wrong tokens from an address, and it has to wait for
+	// the window to pass since the first one
+	maxFailures   = 5
+	failureWindow = 10 * time.Minute
+)
+
+// no 0/o or 1/l, it gets read out loud and typed on phones
+const tokenAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+func newToken() (string, error) {
+	buf := make([]byte, tokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	// 256 is not a multiple of the alphabet, but the bias is not
+	// worth the trouble for something this short lived
+	for i := range buf {
+		buf[i] = tokenAlphabet[int(buf[i])%len(tokenAlphabet)]
+	}
+	return string(buf), nil
+}
+
+type failures struct {
+	count int
+	since time.Time
+}
+
+// auth guards uploads with a token made up at startup. An empty token
+// lets everyone in.
+type auth struct {
+	token string
+
+	mu       sync.Mutex
+	failures map[string]*failures
+}
+
+func newAuth(enabled bool) (*auth, error) {
+	a := &auth{failures: make(map[string]*failures)}
+	if !enabled {
+		return a, nil
+	}
+
+	token, err := newToken()
+	a.token = token
+	return a, err
+}
+
+func (a *auth) enabled() bool { return a.token != "" }
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// blocked is true when ip got the token wrong too many times lately.
+func (a *auth) blocked(ip string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, ok := a.failures[ip]
+	if !ok {
+		return false
+	}
+	if time.Since(f.since) > failureWindow {
+		delete(a.failures, ip)
+		return false
+	}
+	return f.count >= maxFailures
+}
+
+// check tells whether token is the right one, and keeps count of the
+// wrong ones.
+func (a *auth) check(ip, token string) bool {
+	if !a.enabled() {
+		return true
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, ok := a.failures[ip]
+	if !ok || time.Since(f.since) > failureWindow {
+		f = &failures{since: time.Now()}
+		a.failures[ip] = f
+	}
+	f.count++
+
+	return false
+}
+
+// tokenOf finds the token anywhere but the form, which has to be read
+// first.
+func tokenOf(r *http.Request) string {
+	if token := r.Header.Get(tokenHeader); token != "" {
+		return token
+	}
+	if token := r.URL.Query().Get(tokenField); token != "" {
+		return token
+	}
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func (a *auth) setCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    a.token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
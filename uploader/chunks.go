@@ -0,0 +1,420 @@
+package uploader
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Large files are sent in chunks, so that a dropped connection only
+// loses the chunk it was on:
+//
+//   POST /chunks              {"name": "a/b.mp4", "size": 123, "sha256": "..."}
+//   GET  /chunks/<id>         what was received so far
+//   PUT  /chunks/<id>?offset= the bytes from offset on
+//   POST /chunks/<id>         {"sha256": "..."}, put the file in place
+//
+// The sha-256 is optional, and checked against the assembled file when
+// given. What was received is kept on disk under the upload dir, so
+// that it survives a restart of the uploader too.
+
+const (
+	partialDir = ".psy-partial"
+	chunkSize  = 8 << 20
+
+	// partial uploads nobody came back for are removed at startup
+	partialTTL = 7 * 24 * time.Hour
+)
+
+type span struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// partial is an upload that is not done yet.
+type partial struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256,omitempty"`
+	Received  []span `json:"received"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// add merges the bytes from start to end into what was received.
+func (p *partial) add(start, end int64) {
+	spans := append(p.Received, span{start, end})
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+
+	merged := spans[:1]
+	for _, sp := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if sp.Start > last.End {
+			merged = append(merged, sp)
+			continue
+		}
+		if sp.End > last.End {
+			last.End = sp.End
+		}
+	}
+	p.Received = merged
+}
+
+func (p *partial) complete() bool {
+	if p.Size == 0 {
+		return true
+	}
+	return len(p.Received) == 1 && p.Received[0].Start == 0 && p.Received[0].End == p.Size
+}
+
+func validID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+func (s *server) partialPath(id string) string {
+	return filepath.Join(s.conf.Dir, partialDir, id)
+}
+
+func (s *server) loadPartial(id string) (*partial, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(s.partialPath(id), "state.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var p partial
+	if err := json.Unmarshal(dat, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *server) savePartial(p *partial) error {
+	dat, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(s.partialPath(p.ID), "state.json")
+	if err := ioutil.WriteFile(file+".tmp", dat, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// cleanPartials removes the partial uploads left alone for too long.
+func cleanPartials(dir string) {
+	infos, err := ioutil.ReadDir(filepath.Join(dir, partialDir))
+	if err != nil {
+		return
+	}
+
+	for _, fi := range infos {
+		if time.Since(fi.ModTime()) > partialTTL {
+			os.RemoveAll(filepath.Join(dir, partialDir, fi.Name()))
+		}
+	}
+}
+
+// chunkLocks has a lock per upload, so that two requests for the same
+// one do not trip over each other. A lock goes away once nobody holds
+// or waits for it, so finished and abandoned uploads leave nothing
+// behind.
+type chunkLocks struct {
+	mu    sync.Mutex
+	locks map[string]*chunkLock
+}
+
+type chunkLock struct {
+	sync.Mutex
+	users int
+}
+
+func (c *chunkLocks) lock(id string) func() {
+	c.mu.Lock()
+	if c.locks == nil {
+		c.locks = make(map[string]*chunkLock)
+	}
+	l, ok := c.locks[id]
+	if !ok {
+		l = &chunkLock{}
+		c.locks[id] = l
+	}
+	l.users++
+	c.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		c.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(c.locks, id)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func jsonError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &uploadResult{Files: []received{}, Error: err.Error()})
+}
+
+func (s *server) chunks(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/chunks"), "/")
+	switch {
+	case id == "" && r.Method == "POST":
+		s.startChunked(w, r)
+	case !validID(id):
+		jsonError(w, http.StatusNotFound, errors.New("no such upload"))
+	case r.Method == "GET":
+		s.chunkStatus(w, id)
+	case r.Method == "PUT":
+		s.putChunk(w, r, id)
+	case r.Method == "POST":
+		s.finishChunked(w, r, id)
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("only GET, PUT and POST"))
+	}
+}
+
+func (s *server) startChunked(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Sha256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	name, err := sanitizePath(req.Name)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, fmt.Errorf("%v: %v", req.Name, err))
+		return
+	}
+	if req.Size < 0 {
+		jsonError(w, http.StatusBadRequest, errors.New("negative size"))
+		return
+	}
+	if s.maxSize > 0 && req.Size > s.maxSize {
+		jsonError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("the upload is larger than the limit of %v bytes", s.maxSize))
+		return
+	}
+	// the data file is made that size right away
+	if free, ok := freeSpace(s.conf.Dir); ok && req.Size > free {
+		jsonError(w, http.StatusInsufficientStorage, fmt.Errorf("the upload is larger than the %v free", formatSize(free)))
+		return
+	}
+	if _, err := os.Lstat(filepath.Join(s.conf.Dir, name)); err == nil && s.collision == collisionReject {
+		jsonError(w, http.StatusConflict, errExists)
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	p := &partial{
+		ID:        hex.EncodeToString(buf),
+		Name:      filepath.ToSlash(name),
+		Size:      req.Size,
+		Sha256:    strings.ToLower(req.Sha256),
+		Received:  []span{},
+		ChunkSize: chunkSize,
+	}
+
+	if err := os.MkdirAll(s.partialPath(p.ID), 0755); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// sparse, where the filesystem does that
+	data, err := os.Create(filepath.Join(s.partialPath(p.ID), "data"))
+	if err == nil {
+		err = data.Truncate(p.Size)
+		if cerr := data.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = s.savePartial(p)
+	}
+	if err != nil {
+		os.RemoveAll(s.partialPath(p.ID))
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *server) chunkStatus(w http.ResponseWriter, id string) {
+	defer s.chunkLocks.lock(id)()
+
+	p, err := s.loadPartial(id)
+	if err != nil {
+		jsonError(w, http.StatusNotFound, errors.New("no such upload"))
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *server) putChunk(w http.ResponseWriter, r *http.Request, id string) {
+	defer s.chunkLocks.lock(id)()
+
+	p, err := s.loadPartial(id)
+	if err != nil {
+		jsonError(w, http.StatusNotFound, errors.New("no such upload"))
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 || offset > p.Size {
+		jsonError(w, http.StatusBadRequest, errors.New("offset should be within the file"))
+		return
+	}
+
+	data, err := os.OpenFile(filepath.Join(s.partialPath(id), "data"), os.O_WRONLY, 0)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer data.Close()
+
+	if _, err := data.Seek(offset, io.SeekStart); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, chunkSize)
+	n, err := io.Copy(data, io.LimitReader(body, p.Size-offset))
+
+	// whatever made it is kept, even when the client went away
+	if n > 0 {
+		if serr := data.Sync(); serr != nil && err == nil {
+			err = serr
+		}
+		p.add(offset, offset+n)
+		if serr := s.savePartial(p); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	if isTooLarge(err) {
+		jsonError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("chunks are at most %v bytes", chunkSize))
+		return
+	}
+	if err != nil {
+		log.Println("chunk of", p.Name, "failed:", err)
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *server) finishChunked(w http.ResponseWriter, r *http.Request, id string) {
+	defer s.chunkLocks.lock(id)()
+
+	p, err := s.loadPartial(id)
+	if err != nil {
+		jsonError(w, http.StatusNotFound, errors.New("no such upload"))
+		return
+	}
+
+	var req struct {
+		Sha256 string `json:"sha256"`
+	}
+	// no body at all is no checksum, anything else has to make sense
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && err != io.EOF {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !p.complete() {
+		jsonError(w, http.StatusConflict, errors.New("some chunks are missing"))
+		return
+	}
+
+	dataPath := filepath.Join(s.partialPath(id), "data")
+	sum, err := hashFile(dataPath)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	want := strings.ToLower(req.Sha256)
+	if want == "" {
+		want = p.Sha256
+	}
+	if want != "" && want != sum {
+		// no telling which chunk went bad; start over
+		os.RemoveAll(s.partialPath(id))
+		log.Println("checksum of", p.Name, "did not match")
+		jsonError(w, http.StatusUnprocessableEntity, errors.New("checksum mismatch, the upload has to start over"))
+		return
+	}
+
+	dest := filepath.Join(s.conf.Dir, filepath.FromSlash(p.Name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	file, err := s.keep(dataPath, dest, p.Size, sum)
+	// the data was moved in place or thrown away either way; the state
+	// left behind would point at nothing
+	os.RemoveAll(s.partialPath(id))
+	if err == errExists {
+		jsonError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Println("uploaded file: ", file.Name)
+	writeJSON(w, http.StatusOK, &uploadResult{Files: []received{file}})
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
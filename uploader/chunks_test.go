@@ -0,0 +1,133 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testServer is an uploader writing to a temp dir, without a token.
+func testServer(t *testing.T, collision collision) (*server, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "psy-upld-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := defaultConfig()
+	conf.Dir = filepath.Join(dir, "uploads")
+	conf.Collision = string(collision)
+	s, err := newServer(conf, false)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.mux)
+	return s, ts, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func do(t *testing.T, method, url string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	dat, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, dat
+}
+
+// A finish that can not put the file in place takes the partial upload
+// with it, rather than leaving state for data that is gone.
+func TestFinishChunkedConflict(t *testing.T) {
+	s, ts, done := testServer(t, collisionReject)
+	defer done()
+
+	status, dat := do(t, "POST", ts.URL+"/chunks", []byte(`{"name": "taken.txt", "size": 3}`))
+	if status != http.StatusCreated {
+		t.Fatalf("start: %v %s", status, dat)
+	}
+	var p partial
+	if err := json.Unmarshal(dat, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, dat := do(t, "PUT", ts.URL+"/chunks/"+p.ID+"?offset=0", []byte("abc")); status != http.StatusOK {
+		t.Fatalf("put: %v %s", status, dat)
+	}
+
+	// somebody else got there first
+	taken := filepath.Join(s.conf.Dir, "taken.txt")
+	if err := ioutil.WriteFile(taken, []byte("theirs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, dat := do(t, "POST", ts.URL+"/chunks/"+p.ID, nil); status != http.StatusConflict {
+		t.Fatalf("finish: %v %s, want %v", status, dat, http.StatusConflict)
+	}
+	if _, err := os.Stat(s.partialPath(p.ID)); !os.IsNotExist(err) {
+		t.Errorf("partial upload left behind: %v", err)
+	}
+	if status, _ := do(t, "GET", ts.URL+"/chunks/"+p.ID, nil); status != http.StatusNotFound {
+		t.Errorf("status after the conflict: %v, want %v", status, http.StatusNotFound)
+	}
+
+	if dat, _ := ioutil.ReadFile(taken); string(dat) != "theirs" {
+		t.Errorf("the file that was there became %q", dat)
+	}
+}
+
+func TestFinishChunkedBadBody(t *testing.T) {
+	_, ts, done := testServer(t, collisionRename)
+	defer done()
+
+	_, dat := do(t, "POST", ts.URL+"/chunks", []byte(`{"name": "a.txt", "size": 1}`))
+	var p partial
+	if err := json.Unmarshal(dat, &p); err != nil {
+		t.Fatal(err)
+	}
+	do(t, "PUT", ts.URL+"/chunks/"+p.ID+"?offset=0", []byte("a"))
+
+	if status, _ := do(t, "POST", ts.URL+"/chunks/"+p.ID, []byte("{not json")); status != http.StatusBadRequest {
+		t.Errorf("bad body: %v, want %v", status, http.StatusBadRequest)
+	}
+	if status, dat := do(t, "POST", ts.URL+"/chunks/"+p.ID, nil); status != http.StatusOK {
+		t.Errorf("no body: %v %s, want %v", status, dat, http.StatusOK)
+	}
+}
+
+func TestChunkLocksGoAway(t *testing.T) {
+	var c chunkLocks
+	unlock := c.lock("a")
+	done := make(chan struct{})
+	go func() {
+		c.lock("a")()
+		close(done)
+	}()
+	unlock()
+	<-done
+
+	c.lock("b")()
+	c.lock("a")()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.locks) != 0 {
+		t.Errorf("%v locks left", len(c.locks))
+	}
+}
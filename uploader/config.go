@@ -0,0 +1,122 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/psyomn/psy/common"
+
+	"github.com/go-yaml/yaml"
+)
+
+// config has the defaults of the flags; anything in the config file
+// wins over the built in ones, and flags win over both.
+type config struct {
+	Addr      string `yaml:"addr"`
+	Port      int    `yaml:"port"`
+	Dir       string `yaml:"dir"`
+	MaxSize   string `yaml:"max-size"`
+	Collision string `yaml:"collision"`
+
+	Share        string `yaml:"share"`
+	ShareUploads bool   `yaml:"share-uploads"`
+
+	TLS      bool `yaml:"tls"`
+	KeepCert bool `yaml:"keep-cert"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Port:      9090,
+		Dir:       "uploads",
+		MaxSize:   "4G",
+		Collision: string(collisionRename),
+	}
+}
+
+// configDir is empty when there is no HOME, which is what the windows
+// special build usually gets.
+func configDir() string {
+	if os.Getenv("HOME") == "" {
+		return ""
+	}
+	return path.Join(common.ConfigDir(), "uploader")
+}
+
+func configFilePath() string {
+	dir := configDir()
+	if dir == "" {
+		return ""
+	}
+	return path.Join(dir, "config.yaml")
+}
+
+// loadConfig reads the config file over the defaults. Not having one
+// is fine.
+func loadConfig() (*config, error) {
+	conf := defaultConfig()
+
+	file := configFilePath()
+	if file == "" {
+		return conf, nil
+	}
+
+	dat, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(dat, conf); err != nil {
+		return nil, fmt.Errorf("problem reading %v: %v", file, err)
+	}
+
+	return conf, nil
+}
+
+// parseSize reads sizes like 512M or 4G; plain numbers are bytes, and
+// 0 is no limit.
+func parseSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+
+	unit := int64(1)
+	if s != "" {
+		if u, ok := units[s[len(s)-1]]; ok {
+			unit = u
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("size should look like 4096, 512M or 4G")
+	}
+
+	return n * unit, nil
+}
+
+// formatSize is the other way around, for people to read.
+func formatSize(n int64) string {
+	const units = "KMGT"
+	if n < 1<<10 {
+		return fmt.Sprintf("%vB", n)
+	}
+
+	size := float64(n)
+	unit := -1
+	for size >= 1<<10 && unit < len(units)-1 {
+		size /= 1 << 10
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", size, units[unit])
+}
@@ -0,0 +1,285 @@
+package uploader
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Just enough of the dns wire format for mdns service discovery: the
+// questions, and PTR, SRV, TXT and A records. Names are written out in
+// full; those read can be compressed.
+
+const (
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN = 1
+
+	// in questions, the asker wants the answer sent straight back; in
+	// records, the answer replaces what was cached for the name
+	classTopBit = 0x8000
+)
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+
+	target string   // PTR and SRV
+	port   uint16   // SRV
+	txt    []string // TXT
+	ip     net.IP   // A
+}
+
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	questions []dnsQuestion
+	answers   []dnsRecord
+	extra     []dnsRecord // authority and additional records
+}
+
+var errBadMessage = errors.New("malformed dns message")
+
+func (m *dnsMessage) pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	if m.response {
+		b[2] = 0x84 // an authoritative answer
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.extra)))
+
+	var err error
+	for _, q := range m.questions {
+		if b, err = packName(b, q.name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.qtype)
+		b = appendUint16(b, q.class)
+	}
+	for _, records := range [][]dnsRecord{m.answers, m.extra} {
+		for _, rr := range records {
+			if b, err = rr.pack(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func packName(b []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errors.New("bad dns name: " + name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+func (rr *dnsRecord) pack(b []byte) ([]byte, error) {
+	b, err := packName(b, rr.name)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUint16(b, rr.rtype)
+	b = appendUint16(b, rr.class)
+	b = appendUint16(b, uint16(rr.ttl>>16))
+	b = appendUint16(b, uint16(rr.ttl))
+
+	// the length of the data goes here, once it is known
+	at := len(b)
+	b = append(b, 0, 0)
+
+	switch rr.rtype {
+	case typePTR:
+		b, err = packName(b, rr.target)
+	case typeSRV:
+		b = appendUint16(b, 0) // priority
+		b = appendUint16(b, 0) // weight
+		b = appendUint16(b, rr.port)
+		b, err = packName(b, rr.target)
+	case typeTXT:
+		for _, s := range rr.txt {
+			if len(s) > 255 {
+				return nil, errors.New("txt string too long")
+			}
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+		if len(rr.txt) == 0 {
+			b = append(b, 0)
+		}
+	case typeA:
+		b = append(b, rr.ip.To4()...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	binary.BigEndian.PutUint16(b[at:], uint16(len(b)-at-2))
+	return b, nil
+}
+
+func unpackMessage(b []byte) (*dnsMessage, error) {
+	if len(b) < 12 {
+		return nil, errBadMessage
+	}
+
+	m := &dnsMessage{
+		id:       binary.BigEndian.Uint16(b[0:]),
+		response: b[2]&0x80 != 0,
+	}
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	answers := int(binary.BigEndian.Uint16(b[6:]))
+	records := answers + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := unpackName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, errBadMessage
+		}
+		m.questions = append(m.questions, dnsQuestion{
+			name:  name,
+			qtype: binary.BigEndian.Uint16(b[next:]),
+			class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+
+	for i := 0; i < records; i++ {
+		rr, next, err := unpackRecord(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if i < answers {
+			m.answers = append(m.answers, rr)
+		} else {
+			m.extra = append(m.extra, rr)
+		}
+		off = next
+	}
+
+	return m, nil
+}
+
+// unpackName reads the name at off, following compression pointers,
+// and gives the offset right after it.
+func unpackName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errBadMessage
+		}
+
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errBadMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			// pointers pointing at each other would go on forever
+			if jumps++; jumps > 16 {
+				return "", 0, errBadMessage
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+
+		case n&0xc0 != 0:
+			return "", 0, errBadMessage
+
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errBadMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+func unpackRecord(b []byte, off int) (dnsRecord, int, error) {
+	name, off, err := unpackName(b, off)
+	if err != nil {
+		return dnsRecord{}, 0, err
+	}
+	if off+10 > len(b) {
+		return dnsRecord{}, 0, errBadMessage
+	}
+
+	rr := dnsRecord{
+		name:  name,
+		rtype: binary.BigEndian.Uint16(b[off:]),
+		class: binary.BigEndian.Uint16(b[off+2:]),
+		ttl:   binary.BigEndian.Uint32(b[off+4:]),
+	}
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+n > len(b) {
+		return dnsRecord{}, 0, errBadMessage
+	}
+	data := b[off : off+n]
+
+	switch rr.rtype {
+	case typePTR:
+		rr.target, _, err = unpackName(b, off)
+	case typeSRV:
+		if n < 7 {
+			return dnsRecord{}, 0, errBadMessage
+		}
+		rr.port = binary.BigEndian.Uint16(data[4:])
+		rr.target, _, err = unpackName(b, off+6)
+	case typeTXT:
+		for i := 0; i < n; {
+			l := int(data[i])
+			if i+1+l > n {
+				return dnsRecord{}, 0, errBadMessage
+			}
+			if l > 0 {
+				rr.txt = append(rr.txt, string(data[i+1:i+1+l]))
+			}
+			i += 1 + l
+		}
+	case typeA:
+		if n == net.IPv4len {
+			rr.ip = net.IP(append([]byte(nil), data...))
+		}
+	}
+	if err != nil {
+		return dnsRecord{}, 0, err
+	}
+
+	return rr, off + n, nil
+}
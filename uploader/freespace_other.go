@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package uploader
+
+// freeSpace is not known here; uploads find out when they run out.
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
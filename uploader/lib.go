@@ -12,43 +12,150 @@ package uploader
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"io"
+	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
-	"text/template"
 
 	"github.com/psyomn/psy/common"
 )
 
-const (
-	uploadFileHTML = `<html>
-<head>
-       <title>Upload file</title>
-</head>
-<body>
-<h1> Your possible (local network) IPs </h1>
-<p> {{.IPStr}} </p>
-<form enctype="multipart/form-data" action="upload" method="post">
-    <input type="file" name="uploadfile" />
-    <input type="submit" value="upload" />
-</form>
-</body>
-</html>
-`
-	uploadsDir = "uploads/"
-
-	port = ":9090"
-)
+// Run the uploader. Flags default to what is in the config file
+// (~/.config/psy/uploader/config.yaml), if there is one.
+//
+//	psy upld [receive] [flags]                serve the upload page
+//	psy upld send [flags] <host> <files...>   send files to another one
+//	psy upld discover [flags]                 list the ones on the network
+func Run(args common.RunParams) common.RunReturn {
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "send":
+			return send(conf, args[1:])
+		case "discover":
+			return discover(args[1:])
+		case "receive":
+			args = args[1:]
+		}
+	}
+
+	return serve(conf, args)
+}
+
+func serve(conf *config, args []string) error {
+	upldCmd := flag.NewFlagSet("upld", flag.ExitOnError)
+	upldCmd.StringVar(&conf.Addr, "addr", conf.Addr, "<ip> - address to listen on; all of them when empty")
+	upldCmd.IntVar(&conf.Port, "port", conf.Port, "<port> - port to listen on; 0 picks a free one")
+	upldCmd.StringVar(&conf.Dir, "dir", conf.Dir, "<dir> - where uploads are written")
+	upldCmd.StringVar(&conf.MaxSize, "max-size", conf.MaxSize, "<size> - largest upload accepted, eg: 512M or 4G; 0 for no limit")
+	upldCmd.StringVar(&conf.Collision, "collision", conf.Collision, "<rename|overwrite|reject> - what to do with uploads named like a file that is already there")
+	upldCmd.StringVar(&conf.Share, "share", conf.Share, "<dir> - also let others download what is in dir, at /files")
+	upldCmd.BoolVar(&conf.ShareUploads, "share-uploads", conf.ShareUploads, "let others download what was uploaded, at /uploads")
+	upldCmd.BoolVar(&conf.TLS, "tls", conf.TLS, "serve https, with a self-signed certificate made up on the spot")
+	upldCmd.BoolVar(&conf.KeepCert, "keep-cert", conf.KeepCert, "with -tls, keep the certificate under ~/.config/psy/uploader and reuse it")
+	noAuth := upldCmd.Bool("no-auth", false, "let anyone on the network upload, without the token")
+	noQR := upldCmd.Bool("no-qr", false, "do not print qr codes of the upload urls")
+	qrInvert := upldCmd.Bool("qr-invert", false, "swap the colors of the qr codes, when they do not scan; they are drawn for a dark terminal background unless COLORFGBG says otherwise")
+	noMDNS := upldCmd.Bool("no-mdns", false, "do not advertise the uploader on the network, for psy upld discover")
+	upldCmd.Parse(args)
+
+	srv, err := newServer(conf, !*noAuth)
+	if err != nil {
+		return err
+	}
+	srv.qr = !*noQR
+	srv.qrLight = lightTerminal() != *qrInvert
+	srv.mdns = !*noMDNS
+
+	return srv.listenAndServe()
+}
+
+// server is the uploader, with its settings and routes.
+type server struct {
+	conf      *config
+	auth      *auth
+	maxSize   int64
+	collision collision
+	page      *template.Template
+	mux       *http.ServeMux
+
+	chunkLocks chunkLocks
+	sums       sums
+
+	// print the urls as qr codes too, for phones, drawn for a terminal
+	// with a light background or not
+	qr      bool
+	qrLight bool
+	// say it is there over multicast dns
+	mdns bool
+}
+
+func newServer(conf *config, withAuth bool) (*server, error) {
+	maxSize, err := parseSize(conf.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	collision, err := parseCollision(conf.Collision)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newAuth(withAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createDirs(conf.Dir); err != nil {
+		return nil, err
+	}
+
+	srv := &server{
+		conf:      conf,
+		auth:      auth,
+		maxSize:   maxSize,
+		collision: collision,
+		page:      template.Must(template.New("upload-page").Parse(uploadFileHTML)),
+		mux:       http.NewServeMux(),
+	}
+	srv.mux.HandleFunc("/upload", srv.upload)
+	srv.mux.HandleFunc("/chunks", srv.chunks)
+	srv.mux.HandleFunc("/chunks/", srv.chunks)
+	cleanPartials(conf.Dir)
+
+	if conf.Share != "" {
+		if fi, err := os.Stat(conf.Share); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("can not share %v: not a directory", conf.Share)
+		}
+		srv.serveDir("/files", conf.Share)
+	}
+	if conf.ShareUploads {
+		srv.serveDir("/uploads", conf.Dir)
+	}
 
-// Run will run the command with default configs. For now, the
-// uploader does not accept any configuration.
-func Run(_ common.RunParams) common.RunReturn {
-	createDirs()
+	return srv, nil
+}
 
+func (s *server) listenAndServe() error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(s.conf.Addr, strconv.Itoa(s.conf.Port)))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	// with port 0, this is the only way to know which one we got
+	port := ln.Addr().(*net.TCPAddr).Port
 	fmt.Println("listening at port:", port)
 
 	ips, _ := common.GetLocalIP()
@@ -57,40 +164,118 @@ func Run(_ common.RunParams) common.RunReturn {
 		fmt.Println(" ", ip.To4().String())
 	}
 
-	http.HandleFunc("/upload", upload)
-	log.Fatal(http.ListenAndServe(port, nil))
+	if s.conf.Share != "" {
+		fmt.Println("sharing", s.conf.Share, "at /files/")
+	}
+	if s.conf.ShareUploads {
+		fmt.Println("sharing uploads at /uploads/")
+	}
 
-	return nil
+	if s.conf.TLS {
+		cert, err := certificate(ips, s.conf.KeepCert)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("certificate sha-256 fingerprint:")
+		fmt.Println(" ", fingerprint(cert.Certificate[0]))
+
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	if s.auth.enabled() {
+		fmt.Println("upload token:", s.auth.token)
+	}
+	for _, u := range s.urls(ips, port) {
+		fmt.Println(" ", u)
+		if !s.qr {
+			continue
+		}
+		if q, err := encodeQR([]byte(u)); err == nil {
+			q.write(os.Stdout, s.qrLight)
+		}
+	}
+
+	if s.mdns {
+		go s.advertise(port)
+	}
+
+	return http.Serve(ln, s.mux)
 }
 
-func createDirs() {
-	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
-		err := os.MkdirAll(uploadsDir, 0755)
-		if err != nil {
-			log.Println("could not create uploads dir: ", err)
-			os.Exit(1)
+func (s *server) scheme() string {
+	if s.conf.TLS {
+		return "https"
+	}
+	return "http"
+}
+
+// urls are where the upload page can be reached from, token included.
+func (s *server) urls(ips []net.IP, port int) []string {
+	var urls []string
+	for _, ip := range ips {
+		u := url.URL{
+			Scheme: s.scheme(),
+			Host:   net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+			Path:   "/upload",
+		}
+		if s.auth.enabled() {
+			u.RawQuery = url.Values{tokenField: {s.auth.token}}.Encode()
+		}
+		urls = append(urls, u.String())
+	}
+	return urls
+}
+
+func createDirs(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("could not create uploads dir: %v", err)
 		}
 		log.Println("created uploads dir")
 	}
+	return nil
 }
 
-func upload(w http.ResponseWriter, r *http.Request) {
+func (s *server) upload(w http.ResponseWriter, r *http.Request) {
 	type homepage struct {
-		IPStr string
+		IPStr        string
+		NeedToken    bool
+		Share        bool
+		ShareUploads bool
+		ChunkSize    int
+	}
+
+	ip := clientIP(r)
+	if s.auth.enabled() && s.auth.blocked(ip) {
+		http.Error(w, "too many wrong tokens, try again later", http.StatusTooManyRequests)
+		return
 	}
 
 	if r.Method == "GET" {
+		needToken := false
+		if token := tokenOf(r); s.auth.enabled() && (token == "" || !s.auth.check(ip, token)) {
+			needToken = true
+		} else if s.auth.enabled() {
+			s.auth.setCookie(w)
+		}
+
 		var ips []string
 		ipObjs, _ := common.GetLocalIP()
 		for _, ip := range ipObjs {
 			ips = append(ips, ip.To4().String())
 		}
 		ipStr := strings.Join(ips, ",")
-		uploadT := template.Must(template.New("upload-page").Parse(uploadFileHTML))
 
 		var buff bytes.Buffer
 		buffw := bufio.NewWriter(&buff)
-		uploadT.Execute(buffw, &homepage{IPStr: ipStr})
+		s.page.Execute(buffw, &homepage{
+			IPStr:        ipStr,
+			NeedToken:    needToken,
+			Share:        s.conf.Share != "",
+			ShareUploads: s.conf.ShareUploads,
+			ChunkSize:    chunkSize,
+		})
 		buffw.Flush() // for some reason, need to flush explicitly
 		w.Write(buff.Bytes())
 
@@ -102,25 +287,5 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.ParseMultipartForm(1 << 27)
-	file, handler, err := r.FormFile("uploadfile")
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer file.Close()
-
-	uploadsPath := filepath.Join(uploadsDir, handler.Filename)
-	f, err := os.OpenFile(
-		uploadsPath,
-		os.O_WRONLY|os.O_CREATE,
-		0666)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer f.Close()
-
-	io.Copy(f, file)
-	log.Println("uploaded file: ", handler.Filename)
+	s.receive(w, r, ip)
 }
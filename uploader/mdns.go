@@ -0,0 +1,429 @@
+package uploader
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Uploaders say they are there over multicast dns, as a
+// _psy-upload._tcp service, so that psy upld discover can find them
+// without anybody reading addresses out loud. There is no probing for
+// names already taken; the instance name has the port in it, which
+// keeps uploaders on the same computer apart.
+
+const (
+	mdnsService  = "_psy-upload._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsTTL      = 120
+
+	// answers to plain dns resolvers asking on the mdns port are not
+	// meant to be cached for long
+	mdnsLegacyTTL = 10
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// packetConn is what mdns needs of the network; the tests hand packets
+// around in memory instead.
+type packetConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// service is an uploader on the network.
+type service struct {
+	instance string
+	host     string
+	ips      []net.IP
+	port     int
+	txt      []string
+}
+
+// newService describes this uploader, at the given addresses.
+func newService(ips []net.IP, port int, tls, auth bool) *service {
+	label := "psy"
+	if name, err := os.Hostname(); err == nil {
+		label = hostLabel(name)
+	}
+
+	yes := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+
+	return &service{
+		instance: label + ":" + strconv.Itoa(port),
+		host:     label + ".local.",
+		ips:      ips,
+		port:     port,
+		txt:      []string{"txtvers=1", "path=/upload", "tls=" + yes(tls), "auth=" + yes(auth)},
+	}
+}
+
+// hostLabel makes a dns label out of a host name.
+func hostLabel(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+
+	label := strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '-'
+	}, name), "-")
+
+	if len(label) > 50 {
+		label = label[:50]
+	}
+	if label == "" {
+		return "psy"
+	}
+	return label
+}
+
+func (sv *service) name() string {
+	return sv.instance + "." + mdnsService
+}
+
+func (sv *service) value(key string) string {
+	for _, kv := range sv.txt {
+		if strings.HasPrefix(kv, key+"=") {
+			return kv[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+func (sv *service) ptr() dnsRecord {
+	return dnsRecord{name: mdnsService, rtype: typePTR, class: classIN, ttl: mdnsTTL, target: sv.name()}
+}
+
+func (sv *service) srv() dnsRecord {
+	return dnsRecord{name: sv.name(), rtype: typeSRV, class: classIN | classTopBit, ttl: mdnsTTL, target: sv.host, port: uint16(sv.port)}
+}
+
+func (sv *service) text() dnsRecord {
+	return dnsRecord{name: sv.name(), rtype: typeTXT, class: classIN | classTopBit, ttl: mdnsTTL, txt: sv.txt}
+}
+
+func (sv *service) addrs() []dnsRecord {
+	var records []dnsRecord
+	for _, ip := range sv.ips {
+		records = append(records, dnsRecord{name: sv.host, rtype: typeA, class: classIN | classTopBit, ttl: mdnsTTL, ip: ip})
+	}
+	return records
+}
+
+// answer is what sv has to say to the questions, if anything.
+func (sv *service) answer(questions []dnsQuestion) (answers, extra []dnsRecord) {
+	for _, q := range questions {
+		is := func(t uint16) bool { return q.qtype == t || q.qtype == typeANY }
+
+		switch name := strings.ToLower(q.name); {
+		case name == mdnsServices && is(typePTR):
+			answers = append(answers, dnsRecord{name: mdnsServices, rtype: typePTR, class: classIN, ttl: mdnsTTL, target: mdnsService})
+
+		case name == mdnsService && is(typePTR):
+			answers = append(answers, sv.ptr())
+			extra = append(extra, sv.srv(), sv.text())
+			extra = append(extra, sv.addrs()...)
+
+		case name == strings.ToLower(sv.name()):
+			if is(typeSRV) {
+				answers = append(answers, sv.srv())
+				extra = append(extra, sv.addrs()...)
+			}
+			if is(typeTXT) {
+				answers = append(answers, sv.text())
+			}
+
+		case name == strings.ToLower(sv.host) && is(typeA):
+			answers = append(answers, sv.addrs()...)
+		}
+	}
+	return answers, extra
+}
+
+// advertise answers the questions about sv that come in on conn, until
+// it fails or is closed. It tells everyone it is there a couple of
+// times first, as mdns responders do.
+func advertise(conn packetConn, group net.Addr, sv *service) error {
+	announcement, err := (&dnsMessage{
+		response: true,
+		answers:  append([]dnsRecord{sv.ptr(), sv.srv(), sv.text()}, sv.addrs()...),
+	}).pack()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn.WriteTo(announcement, group)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		query, err := unpackMessage(buf[:n])
+		if err != nil || query.response {
+			continue
+		}
+		answers, extra := sv.answer(query.questions)
+		if len(answers) == 0 {
+			continue
+		}
+
+		reply := &dnsMessage{response: true, answers: answers, extra: extra}
+		to := group
+		if udp, ok := from.(*net.UDPAddr); ok && udp.Port != mdnsGroup.Port {
+			// a plain dns query, which wants its answer back like any
+			// other dns query does
+			reply.id = query.id
+			reply.questions = query.questions
+			reply.answers = legacy(reply.answers)
+			reply.extra = legacy(reply.extra)
+			to = from
+		} else if len(query.questions) > 0 && query.questions[0].class&classTopBit != 0 {
+			to = from
+		}
+
+		pkt, err := reply.pack()
+		if err != nil {
+			return err
+		}
+		conn.WriteTo(pkt, to)
+	}
+}
+
+func legacy(records []dnsRecord) []dnsRecord {
+	out := make([]dnsRecord, len(records))
+	for i, rr := range records {
+		rr.class &^= classTopBit
+		if rr.ttl > mdnsLegacyTTL {
+			rr.ttl = mdnsLegacyTTL
+		}
+		out[i] = rr
+	}
+	return out
+}
+
+// browse asks who is there, and gathers the answers that come back
+// within wait. The question goes out again every second, in case it
+// got lost.
+func browse(conn packetConn, group net.Addr, wait time.Duration) ([]*service, error) {
+	query, err := (&dnsMessage{
+		questions: []dnsQuestion{{mdnsService, typePTR, classIN}},
+	}).pack()
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]*service{}
+	get := func(name string) *service {
+		key := strings.ToLower(name)
+		if !strings.HasSuffix(key, "."+mdnsService) {
+			return nil
+		}
+		sv, ok := found[key]
+		if !ok {
+			sv = &service{instance: name[:len(name)-len(mdnsService)-1]}
+			found[key] = sv
+		}
+		return sv
+	}
+	hosts := map[string][]net.IP{}
+
+	buf := make([]byte, 9000)
+	deadline := time.Now().Add(wait)
+	next := time.Now()
+	for time.Now().Before(deadline) {
+		if !time.Now().Before(next) {
+			if _, err := conn.WriteTo(query, group); err != nil {
+				return nil, err
+			}
+			next = next.Add(time.Second)
+		}
+
+		until := deadline
+		if next.Before(until) {
+			until = next
+		}
+		conn.SetReadDeadline(until)
+
+		n, _, err := conn.ReadFrom(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := unpackMessage(buf[:n])
+		if err != nil || !reply.response {
+			continue
+		}
+
+		for _, rr := range append(reply.answers, reply.extra...) {
+			switch rr.rtype {
+			case typePTR:
+				if strings.ToLower(rr.name) == mdnsService {
+					get(rr.target)
+				}
+			case typeSRV:
+				if sv := get(rr.name); sv != nil {
+					sv.host, sv.port = rr.target, int(rr.port)
+				}
+			case typeTXT:
+				if sv := get(rr.name); sv != nil {
+					sv.txt = rr.txt
+				}
+			case typeA:
+				if rr.ip == nil {
+					continue
+				}
+				host := strings.ToLower(rr.name)
+				seen := false
+				for _, ip := range hosts[host] {
+					seen = seen || ip.Equal(rr.ip)
+				}
+				if !seen {
+					hosts[host] = append(hosts[host], rr.ip)
+				}
+			}
+		}
+	}
+
+	var services []*service
+	for _, sv := range found {
+		if sv.port == 0 {
+			continue // never said where it is
+		}
+		sv.ips = hosts[strings.ToLower(sv.host)]
+		services = append(services, sv)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].instance < services[j].instance })
+	return services, nil
+}
+
+// lanIPs are the addresses this computer has on its networks.
+func lanIPs() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ips = append(ips, ipnet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// advertise says the uploader is there, for as long as it runs. Not
+// being able to is no reason to stop it; it can still be found by
+// address.
+func (s *server) advertise(port int) {
+	ips := lanIPs()
+	if ip := net.ParseIP(s.conf.Addr); ip != nil && !ip.IsUnspecified() {
+		if ip.IsLoopback() {
+			return
+		}
+		ips = []net.IP{ip}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		log.Println("not advertising on the network:", err)
+		return
+	}
+	defer conn.Close()
+
+	sv := newService(ips, port, s.conf.TLS, s.auth.enabled())
+	if err := advertise(conn, mdnsGroup, sv); err != nil {
+		log.Println("stopped advertising on the network:", err)
+	}
+}
+
+func discover(args []string) error {
+	discoverCmd := flag.NewFlagSet("upld discover", flag.ExitOnError)
+	wait := discoverCmd.Duration("wait", 2*time.Second, "<duration> - how long to wait for uploaders to answer")
+	discoverCmd.Parse(args)
+
+	// A one-shot query, from a port of its own (RFC 6762, 5.1), which
+	// gets the answers meant for plain dns, sent straight back: a ttl
+	// of 10s and no cache-flush bit, neither of which matters to a
+	// question asked once and not cached. Asking from 5353 instead would
+	// get the answers sent to the group, but a socket from
+	// ListenMulticastUDP does not hear what is sent to the group from
+	// the same computer, so uploaders running next to it would go
+	// unnoticed.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	services, err := browse(conn, mdnsGroup, *wait)
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		fmt.Println("no uploaders found")
+		return nil
+	}
+
+	writer := new(tabwriter.Writer)
+	writer.Init(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "host\taddresses\tport\turl")
+	for _, sv := range services {
+		var addrs []string
+		for _, ip := range sv.ips {
+			addrs = append(addrs, ip.String())
+		}
+
+		link := "-"
+		if len(sv.ips) > 0 {
+			scheme := "http"
+			if sv.value("tls") == "1" {
+				scheme = "https"
+			}
+			link = fmt.Sprintf("%v://%v%v", scheme, net.JoinHostPort(sv.ips[0].String(), strconv.Itoa(sv.port)), sv.value("path"))
+			if sv.value("auth") == "1" {
+				link += " (token needed)"
+			}
+		}
+
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", strings.TrimSuffix(sv.host, "."), strings.Join(addrs, ","), sv.port, link)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,243 @@
+package uploader
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hub stands in for a network with multicast: packets for the group go
+// to everyone on the group's port, the rest to whoever has the address.
+type hub struct {
+	mu    sync.Mutex
+	conns []*loopConn
+}
+
+type packet struct {
+	b    []byte
+	from net.Addr
+}
+
+func (h *hub) listen(ip string, port int) *loopConn {
+	c := &loopConn{
+		hub:    h,
+		addr:   &net.UDPAddr{IP: net.ParseIP(ip), Port: port},
+		in:     make(chan packet, 64),
+		closed: make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.conns = append(h.conns, c)
+	h.mu.Unlock()
+	return c
+}
+
+// loopConn is a packetConn on a hub.
+type loopConn struct {
+	hub  *hub
+	addr *net.UDPAddr
+	in   chan packet
+
+	mu       sync.Mutex
+	deadline time.Time
+	closed   chan struct{}
+	once     sync.Once
+}
+
+var errClosed = errors.New("closed")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (c *loopConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.in:
+		return copy(b, p.b), p.from, nil
+	case <-c.closed:
+		return 0, nil, errClosed
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+func (c *loopConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+
+	to := addr.(*net.UDPAddr)
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	for _, peer := range c.hub.conns {
+		if peer.addr.Port != to.Port || !to.IP.IsMulticast() && !peer.addr.IP.Equal(to.IP) {
+			continue
+		}
+		select {
+		case peer.in <- packet{append([]byte(nil), b...), c.addr}:
+		default: // dropped, as udp does
+		}
+	}
+	return len(b), nil
+}
+
+func (c *loopConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *loopConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func testService(name, ip string, port int, tls bool) *service {
+	sv := newService([]net.IP{net.ParseIP(ip).To4()}, port, tls, true)
+	sv.instance = name
+	sv.host = name + ".local."
+	return sv
+}
+
+func TestAdvertiseBrowse(t *testing.T) {
+	var h hub
+	services := []*service{
+		testService("one", "192.0.2.1", 9090, false),
+		testService("two", "192.0.2.2", 9443, true),
+	}
+
+	done := make(chan error, len(services))
+	var conns []*loopConn
+	for _, sv := range services {
+		conn := h.listen(sv.ips[0].String(), mdnsGroup.Port)
+		conns = append(conns, conn)
+		go func(sv *service) { done <- advertise(conn, mdnsGroup, sv) }(sv)
+	}
+
+	found, err := browse(h.listen("192.0.2.9", mdnsGroup.Port), mdnsGroup, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != len(services) {
+		t.Fatalf("found %v uploaders, want %v", len(found), len(services))
+	}
+	for i, sv := range found {
+		want := services[i]
+		if sv.instance != want.instance || sv.host != want.host || sv.port != want.port {
+			t.Errorf("found %v at %v:%v, want %v at %v:%v", sv.instance, sv.host, sv.port, want.instance, want.host, want.port)
+		}
+		if len(sv.ips) != 1 || !sv.ips[0].Equal(want.ips[0]) {
+			t.Errorf("%v: addresses %v, want %v", sv.instance, sv.ips, want.ips)
+		}
+		if sv.value("tls") != want.value("tls") || sv.value("auth") != "1" || sv.value("path") != "/upload" {
+			t.Errorf("%v: txt %v, want %v", sv.instance, sv.txt, want.txt)
+		}
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for range services {
+		if err := <-done; err != errClosed {
+			t.Errorf("advertise stopped with %v", err)
+		}
+	}
+}
+
+// A question from any port but the mdns one is a plain dns query, and
+// gets a plain dns answer, straight back.
+func TestAdvertiseLegacy(t *testing.T) {
+	var h hub
+	advertiser := h.listen("192.0.2.1", mdnsGroup.Port)
+	defer advertiser.Close()
+	go advertise(advertiser, mdnsGroup, testService("one", "192.0.2.1", 9090, false))
+
+	asker := h.listen("192.0.2.9", 40000)
+	query, err := (&dnsMessage{
+		id:        0x1234,
+		questions: []dnsQuestion{{mdnsService, typePTR, classIN}},
+	}).pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asker.WriteTo(query, mdnsGroup)
+
+	buf := make([]byte, 9000)
+	for {
+		asker.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := asker.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := unpackMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.questions) == 0 {
+			continue // the announcement, which is not for us
+		}
+
+		if reply.id != 0x1234 || reply.questions[0].name != mdnsService {
+			t.Errorf("reply id %#x, questions %v; want the query's", reply.id, reply.questions)
+		}
+		if len(reply.answers) == 0 {
+			t.Fatal("no answers")
+		}
+		for _, rr := range append(reply.answers, reply.extra...) {
+			if rr.ttl > mdnsLegacyTTL || rr.class&classTopBit != 0 {
+				t.Errorf("%v: ttl %v, class %#x; want a plain dns record", rr.name, rr.ttl, rr.class)
+			}
+		}
+		return
+	}
+}
+
+func TestUnpackName(t *testing.T) {
+	// a.b. at 12, then c. and a pointer to it
+	msg := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 'a', 1, 'b', 0,
+		1, 'c', 0xc0, 12,
+	}
+	name, next, err := unpackName(msg, 17)
+	if err != nil || name != "c.a.b." || next != len(msg) {
+		t.Errorf("got %q, %v, %v; want c.a.b., %v", name, next, err, len(msg))
+	}
+
+	// two pointers pointing at each other
+	loop := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xc0, 14, 0xc0, 12}
+	if _, _, err := unpackName(loop, 12); err != errBadMessage {
+		t.Errorf("pointer loop: %v, want %v", err, errBadMessage)
+	}
+}
+
+func TestHostLabel(t *testing.T) {
+	tests := map[string]string{
+		"laptop.example.com": "laptop",
+		"Simon's MacBook":    "Simon-s-MacBook",
+		"---":                "psy",
+		"":                   "psy",
+	}
+	for name, want := range tests {
+		if got := hostLabel(name); got != want {
+			t.Errorf("hostLabel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
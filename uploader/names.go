@@ -0,0 +1,178 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// collision is what happens when an upload has the name of a file that
+// is already there.
+type collision string
+
+const (
+	collisionRename    collision = "rename"
+	collisionOverwrite collision = "overwrite"
+	collisionReject    collision = "reject"
+)
+
+func parseCollision(s string) (collision, error) {
+	switch c := collision(s); c {
+	case collisionRename, collisionOverwrite, collisionReject:
+		return c, nil
+	}
+	return "", fmt.Errorf("no such collision policy: %v (want rename, overwrite or reject)", s)
+}
+
+var errExists = errors.New("a file with that name is already there")
+
+// names windows will not have, whatever the extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+const maxNameLength = 255
+
+// tempPrefix starts the names of uploads still being written.
+const tempPrefix = ".psy-upload-"
+
+// ours is true of the names the uploader keeps for itself, which no
+// upload gets to have, at any depth.
+func ours(name string) bool {
+	return strings.EqualFold(name, partialDir) || strings.EqualFold(name, sumsFile) ||
+		strings.HasPrefix(strings.ToLower(name), tempPrefix)
+}
+
+// sanitizeName turns the file name a browser sent into one that is
+// safe to write in the upload dir, on any system: no directories, no
+// control characters or characters windows refuses, and none of its
+// reserved names. Ours are refused.
+func sanitizeName(name string) (string, error) {
+	// some browsers send the whole path, with either separator
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	// windows drops these, which could make two names the same file
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+
+	if name == "" || name == "." || name == ".." {
+		return "", errors.New("not a usable file name")
+	}
+
+	base := strings.ToUpper(name)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.TrimSpace(base)] {
+		name = "_" + name
+	}
+	if ours(name) {
+		return "", fmt.Errorf("%v is a name the uploader keeps for itself", name)
+	}
+
+	if len(name) > maxNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > maxNameLength/2 {
+			ext = ""
+		}
+		stem := name[:maxNameLength-len(ext)]
+		// do not cut a utf-8 sequence in half
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+
+	return name, nil
+}
+
+// maxDepth is how many directories deep a folder upload can go.
+const maxDepth = 32
+
+// sanitizePath is sanitizeName for every element of a relative path,
+// from a folder upload. It gives a path with the local separator.
+func sanitizePath(rel string) (string, error) {
+	var parts []string
+	for _, part := range strings.FieldsFunc(rel, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == "." {
+			continue
+		}
+		if part == ".." {
+			return "", errors.New("paths can not go up")
+		}
+
+		name, err := sanitizeName(part)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, name)
+	}
+
+	if len(parts) == 0 {
+		return "", errors.New("not a usable file name")
+	}
+	if len(parts) > maxDepth {
+		return "", errors.New("too many directories deep")
+	}
+
+	return filepath.Join(parts...), nil
+}
+
+// numbered is name (n).ext
+func numbered(dest string, n int) string {
+	ext := filepath.Ext(dest)
+	return fmt.Sprintf("%v (%v)%v", strings.TrimSuffix(dest, ext), n, ext)
+}
+
+// place moves the finished temp file to dest, or next to it, following
+// the collision policy. It returns where the file ended up.
+func place(tmp, dest string, policy collision) (string, error) {
+	if policy == collisionOverwrite {
+		return dest, os.Rename(tmp, dest)
+	}
+
+	for n := 0; n < 1000; n++ {
+		candidate := dest
+		if n > 0 {
+			candidate = numbered(dest, n)
+		}
+
+		// a link fails if the name is taken, where checking first and
+		// renaming after could clobber a file that just showed up
+		err := os.Link(tmp, candidate)
+		if err == nil {
+			return candidate, os.Remove(tmp)
+		}
+
+		if !os.IsExist(err) {
+			// no hard links on this filesystem
+			if _, serr := os.Lstat(candidate); os.IsNotExist(serr) {
+				return candidate, os.Rename(tmp, candidate)
+			}
+		}
+
+		if policy == collisionReject {
+			return "", errExists
+		}
+	}
+
+	return "", errExists
+}
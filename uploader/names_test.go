@@ -0,0 +1,135 @@
+package uploader
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // empty when refused
+	}{
+		{"photo.jpg", "photo.jpg"},
+
+		// directories are dropped, whichever the separator
+		{"../../etc/evil", "evil"},
+		{"/etc/passwd", "passwd"},
+		{`C:\Users\me\photo.jpg`, "photo.jpg"},
+		{`..\..\evil.exe`, "evil.exe"},
+		{"..", ""},
+		{".", ""},
+		{"a/..", ""},
+		{"", ""},
+
+		// control characters go, the ones windows refuses are replaced
+		{"a\x00b.txt", "ab.txt"},
+		{"a\nb\x7f.txt", "ab.txt"},
+		{`what?<is>"this"|*:.txt`, "what__is__this____.txt"},
+		{"\x01\x02", ""},
+
+		// windows drops these, so they go
+		{"report.txt. . ", "report.txt"},
+		{"  spaced  ", "spaced"},
+		{"...", ""},
+
+		// windows reserved names, whatever the extension or case
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"LPT9.tar.gz", "_LPT9.tar.gz"},
+		{"CONSOLE.txt", "CONSOLE.txt"},
+
+		// ours
+		{"SHA256SUMS", ""},
+		{"sha256sums", ""},
+		{".psy-partial", ""},
+		{".psy-upload-123", ""},
+		{"dir/SHA256SUMS", ""},
+		{"SHA256SUMS.txt", "SHA256SUMS.txt"},
+	}
+
+	for _, tt := range tests {
+		got, err := sanitizeName(tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("sanitizeName(%q) = %q, want it refused", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("sanitizeName(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSanitizeNameLong(t *testing.T) {
+	got, err := sanitizeName(strings.Repeat("a", 300) + ".tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != maxNameLength || !strings.HasSuffix(got, ".gz") {
+		t.Errorf("got %v bytes ending in %q, want %v ending in .gz", len(got), got[len(got)-3:], maxNameLength)
+	}
+
+	// cut on a character, not in the middle of one
+	got, err = sanitizeName(strings.Repeat("é", 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > maxNameLength || !utf8.ValidString(got) {
+		t.Errorf("got %v bytes, valid utf-8 %v", len(got), utf8.ValidString(got))
+	}
+}
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want string // with slashes; empty when refused
+	}{
+		{"a/b/c.txt", "a/b/c.txt"},
+		{`a\b\c.txt`, "a/b/c.txt"},
+		{"./a//b/./c.txt", "a/b/c.txt"},
+		{"/etc/passwd", "etc/passwd"},
+		{`C:\x\y.txt`, "C_/x/y.txt"},
+		{"a/con/aux.txt", "a/_con/_aux.txt"},
+		{"a. /b .txt", "a/b .txt"},
+		{"a/b\x00c/d", "a/bc/d"},
+
+		// no going up, at any depth
+		{"../x/a", ""},
+		{"a/../../x", ""},
+		{`a\..\x`, ""},
+
+		// nothing left
+		{"", ""},
+		{"./.", ""},
+		{"a/\x01/b", ""},
+
+		// ours, at any depth
+		{"SHA256SUMS", ""},
+		{"sub/SHA256SUMS", ""},
+		{".psy-partial/0123456789abcdef0123456789abcdef/state.json", ""},
+		{"a/.PSY-PARTIAL/x", ""},
+		{"a/.psy-upload-42", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := sanitizePath(tt.rel)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("sanitizePath(%q) = %q, want it refused", tt.rel, got)
+			}
+			continue
+		}
+		if err != nil || filepath.ToSlash(got) != tt.want {
+			t.Errorf("sanitizePath(%q) = %q, %v; want %q", tt.rel, got, err, tt.want)
+		}
+	}
+
+	deep := strings.Repeat("d/", maxDepth) + "f"
+	if _, err := sanitizePath(deep); err == nil {
+		t.Errorf("%v directories deep was let through", maxDepth)
+	}
+}
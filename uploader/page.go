@@ -0,0 +1,388 @@
+package uploader
+
+// The upload page is all in here, so that the uploader stays a single
+// binary. Without javascript it is a plain form that takes many files;
+// with it, files and folders can be dropped on it, and each file is
+// sent on its own with its progress shown. Files larger than a chunk
+// go through /chunks, and pick up where they left off when the
+// connection drops, or when the same file is picked again later. Every
+// file is hashed while it is sent, and checked against the sha-256 the
+// uploader got.
+const uploadFileHTML = `<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Upload file</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 1em auto; padding: 0 1em; }
+#drop { border: 2px dashed #888; border-radius: 8px; padding: 2em; text-align: center; }
+#drop.over { background: #eef; }
+#queue { width: 100%; border-collapse: collapse; margin: 1em 0; }
+#queue td { padding: 2px 4px; }
+progress { width: 100%; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1> Your possible (local network) IPs </h1>
+<p> {{.IPStr}} </p>
+{{if or .Share .ShareUploads}}<p>download:
+{{if .Share}}    <a href="files/">shared files</a>
+{{end}}{{if .ShareUploads}}    <a href="uploads/">uploaded files</a>
+{{end}}</p>
+{{end}}<form id="form" enctype="multipart/form-data" action="upload" method="post">
+{{if .NeedToken}}    <p><input type="text" id="token" name="token" placeholder="token" autocomplete="off" /></p>
+{{end}}    <div id="drop">
+        <p>drop files or folders here, or</p>
+        <p>files: <input type="file" id="files" name="uploadfile" multiple /></p>
+        <p>a folder: <input type="file" id="folder" webkitdirectory multiple /></p>
+    </div>
+    <p><input type="submit" value="upload" /></p>
+</form>
+<div id="progress" hidden>
+    <p>overall <progress id="overall" max="1" value="0"></progress></p>
+    <table id="queue"></table>
+</div>
+<div id="summary"></div>
+<script>
+(function() {
+    var K = [
+        0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+        0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+        0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+        0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+        0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+        0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+        0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+        0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+    ];
+
+    // Sha256 is sha-256 a piece at a time; crypto.subtle can not do
+    // that, and is not there at all over plain http.
+    function Sha256() {
+        this.h = new Int32Array([0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19]);
+        this.w = new Int32Array(64);
+        this.buf = new Uint8Array(64);
+        this.n = 0;
+        this.len = 0;
+    }
+
+    Sha256.prototype.update = function(data) {
+        var i = 0;
+        this.len += data.length;
+        if (this.n) {
+            while (this.n < 64 && i < data.length) this.buf[this.n++] = data[i++];
+            if (this.n < 64) return;
+            this.block(this.buf, 0);
+            this.n = 0;
+        }
+        for (; i + 64 <= data.length; i += 64) this.block(data, i);
+        while (i < data.length) this.buf[this.n++] = data[i++];
+    };
+
+    Sha256.prototype.block = function(d, off) {
+        var w = this.w, h = this.h, i;
+        for (i = 0; i < 16; i++) {
+            var j = off + 4 * i;
+            w[i] = (d[j] << 24) | (d[j + 1] << 16) | (d[j + 2] << 8) | d[j + 3];
+        }
+        for (i = 16; i < 64; i++) {
+            var x = w[i - 15], y = w[i - 2];
+            var s0 = ((x >>> 7) | (x << 25)) ^ ((x >>> 18) | (x << 14)) ^ (x >>> 3);
+            var s1 = ((y >>> 17) | (y << 15)) ^ ((y >>> 19) | (y << 13)) ^ (y >>> 10);
+            w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+        }
+
+        var a = h[0], b = h[1], c = h[2], e = h[4], f = h[5], g = h[6];
+        var dd = h[3], hh = h[7];
+        for (i = 0; i < 64; i++) {
+            var S1 = ((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7));
+            var t1 = (hh + S1 + ((e & f) ^ (~e & g)) + K[i] + w[i]) | 0;
+            var S0 = ((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10));
+            var t2 = (S0 + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+            hh = g; g = f; f = e; e = (dd + t1) | 0;
+            dd = c; c = b; b = a; a = (t1 + t2) | 0;
+        }
+
+        h[0] += a; h[1] += b; h[2] += c; h[3] += dd;
+        h[4] += e; h[5] += f; h[6] += g; h[7] += hh;
+    };
+
+    Sha256.prototype.hex = function() {
+        var len = this.len;
+        var pad = new Uint8Array((this.n < 56 ? 64 : 128) - this.n);
+        pad[0] = 0x80;
+        var hi = Math.floor(len / 0x20000000), lo = (len * 8) >>> 0;
+        for (var i = 0; i < 4; i++) {
+            pad[pad.length - 8 + i] = (hi >>> (24 - 8 * i)) & 0xff;
+            pad[pad.length - 4 + i] = (lo >>> (24 - 8 * i)) & 0xff;
+        }
+        this.update(pad);
+
+        var out = '';
+        for (i = 0; i < 8; i++) out += ('0000000' + (this.h[i] >>> 0).toString(16)).slice(-8);
+        return out;
+    };
+
+    // hash reads the file a slice at a time, and lets the ones waiting
+    // on it know.
+    function hash(item) {
+        var sha = new Sha256(), off = 0, slice = 4 << 20;
+        item.waiting = [];
+        function ready(sum) {
+            item.sha256 = sum;
+            item.waiting.forEach(function(fn) { fn(sum); });
+        }
+        function step() {
+            if (off >= item.file.size) return ready(sha.hex());
+            var reader = new FileReader();
+            reader.onload = function() {
+                sha.update(new Uint8Array(reader.result));
+                off += slice;
+                setTimeout(step, 0);
+            };
+            reader.onerror = function() { ready(''); };
+            reader.readAsArrayBuffer(item.file.slice(off, off + slice));
+        }
+        step();
+    }
+
+    function hashed(item, fn) {
+        if (item.sha256 !== undefined) fn(item.sha256); else item.waiting.push(fn);
+    }
+    var form = document.getElementById('form');
+    var drop = document.getElementById('drop');
+    var token = document.getElementById('token');
+    var chunkSize = {{.ChunkSize}};
+    var queue = [];
+
+    function parse(xhr) {
+        try { return JSON.parse(xhr.responseText); } catch (err) { return {error: xhr.statusText || 'connection lost'}; }
+    }
+
+    function request(method, url, onload) {
+        var xhr = new XMLHttpRequest();
+        xhr.open(method, url);
+        xhr.setRequestHeader('Accept', 'application/json');
+        if (token) xhr.setRequestHeader('X-Psy-Token', token.value);
+        xhr.addEventListener('load', function() { onload(xhr.status, parse(xhr)); });
+        xhr.addEventListener('error', function() { onload(0, {error: 'connection lost'}); });
+        return xhr;
+    }
+
+    // sendChunked sends the chunks the server does not have yet,
+    // retrying for a while when the connection goes away. The upload
+    // id is remembered, to resume even after the page is reloaded.
+    function sendChunked(item, progress, done) {
+        var file = item.file;
+        var key = 'psy-upload:' + item.path + ':' + file.size + ':' + file.lastModified;
+        var failures = 0;
+
+        function retry(again) {
+            if (++failures > 20) return done({error: 'gave up, the connection keeps dropping'});
+            setTimeout(again, Math.min(30, failures * 2) * 1000);
+        }
+
+        function has(st, start, end) {
+            for (var i = 0; i < st.received.length; i++) {
+                if (st.received[i].start <= start && st.received[i].end >= end) return true;
+            }
+            return false;
+        }
+
+        function got(st) {
+            var n = 0;
+            st.received.forEach(function(r) { n += r.end - r.start; });
+            return n;
+        }
+
+        function next(st) {
+            for (var off = 0; off < file.size; off += chunkSize) {
+                var end = Math.min(off + chunkSize, file.size);
+                if (!has(st, off, end)) return put(st, off, end);
+            }
+            finish(st);
+        }
+
+        function put(st, off, end) {
+            var base = got(st);
+            var xhr = request('PUT', 'chunks/' + st.id + '?offset=' + off, function(code, res) {
+                if (code === 200) { failures = 0; return next(res); }
+                if (code === 0 || code >= 500) return retry(function() { resume(st.id); });
+                done(res);
+            });
+            xhr.upload.addEventListener('progress', function(e) { progress(base + e.loaded); });
+            xhr.send(file.slice(off, end));
+        }
+
+        function finish(st) {
+            hashed(item, function(sum) {
+                request('POST', 'chunks/' + st.id, function(code, res) {
+                    if (code === 0 || code >= 500) return retry(function() { resume(st.id); });
+                    if (code === 409 && res.error === 'some chunks are missing') return resume(st.id);
+                    localStorage.removeItem(key);
+                    done(res);
+                }).send(JSON.stringify({sha256: sum}));
+            });
+        }
+
+        function resume(id) {
+            request('GET', 'chunks/' + id, function(code, res) {
+                if (code === 200) return next(res);
+                if (code === 404) { localStorage.removeItem(key); return start(); }
+                if (code === 0 || code >= 500) return retry(function() { resume(id); });
+                done(res);
+            }).send();
+        }
+
+        function start() {
+            request('POST', 'chunks', function(code, res) {
+                if (code === 201) { localStorage.setItem(key, res.id); return next(res); }
+                if (code === 0 || code >= 500) return retry(start);
+                done(res);
+            }).send(JSON.stringify({name: item.path, size: file.size}));
+        }
+
+        var id = localStorage.getItem(key);
+        if (id) resume(id); else start();
+    }
+
+    function add(file, path) {
+        var row = document.getElementById('queue').insertRow(-1);
+        row.insertCell(-1).textContent = path;
+        var bar = document.createElement('progress');
+        bar.max = 1;
+        bar.value = 0;
+        row.insertCell(-1).appendChild(bar);
+        queue.push({file: file, path: path, bar: bar, row: row});
+        document.getElementById('progress').hidden = false;
+    }
+
+    function addList(files) {
+        for (var i = 0; i < files.length; i++) {
+            add(files[i], files[i].webkitRelativePath || files[i].name);
+        }
+    }
+
+    // folders only come through the entries api
+    function walk(entry) {
+        if (entry.isFile) {
+            entry.file(function(file) { add(file, entry.fullPath.replace(/^\//, '')); });
+        } else if (entry.isDirectory) {
+            var reader = entry.createReader();
+            var more = function() {
+                reader.readEntries(function(entries) {
+                    if (!entries.length) return;
+                    entries.forEach(walk);
+                    more();
+                });
+            };
+            more();
+        }
+    }
+
+    document.getElementById('files').addEventListener('change', function(e) { addList(e.target.files); e.target.value = ''; });
+    document.getElementById('folder').addEventListener('change', function(e) { addList(e.target.files); e.target.value = ''; });
+
+    drop.addEventListener('dragover', function(e) { e.preventDefault(); drop.className = 'over'; });
+    drop.addEventListener('dragleave', function() { drop.className = ''; });
+    drop.addEventListener('drop', function(e) {
+        e.preventDefault();
+        drop.className = '';
+        var items = e.dataTransfer.items;
+        if (items && items.length && items[0].webkitGetAsEntry) {
+            for (var i = 0; i < items.length; i++) {
+                var entry = items[i].webkitGetAsEntry();
+                if (entry) walk(entry);
+            }
+        } else {
+            addList(e.dataTransfer.files);
+        }
+    });
+
+    form.addEventListener('submit', function(e) {
+        e.preventDefault();
+        var total = 0;
+        queue.forEach(function(item) { total += item.file.size; });
+        var done = 0;
+        var received = [];
+        var failed = [];
+        var overall = document.getElementById('overall');
+
+        function finish() {
+            var summary = document.getElementById('summary');
+            var bytes = 0;
+            received.forEach(function(f) { bytes += f.size; });
+            var html = '<h2>received ' + received.length + ' files, ' + bytes + ' bytes</h2><ul></ul>';
+            summary.innerHTML = html;
+            var list = summary.querySelector('ul');
+            received.forEach(function(f) {
+                var li = document.createElement('li');
+                li.textContent = f.name + ' (' + f.size + ' bytes) sha-256 ' + f.sha256 + (f.verified ? ' verified' : '');
+                list.appendChild(li);
+            });
+            failed.forEach(function(f) {
+                var li = document.createElement('li');
+                li.className = 'failed';
+                li.textContent = f.path + ': ' + f.error;
+                list.appendChild(li);
+            });
+            queue = [];
+        }
+
+        function progress(item, sent) {
+            item.bar.value = item.file.size ? sent / item.file.size : 1;
+            overall.value = total ? (done + sent) / total : 1;
+        }
+
+        function handled(i, item, res) {
+            hashed(item, function(sum) {
+                (res.files || []).forEach(function(f) {
+                    f.verified = sum !== '' && f.sha256 === sum;
+                    if (!f.verified) res.error = res.error || 'checksum mismatch: sent ' + sum + ', the uploader got ' + f.sha256;
+                    received.push(f);
+                });
+                if (res.error) {
+                    item.row.className = 'failed';
+                    failed.push({path: item.path, error: res.error});
+                }
+                item.bar.value = 1;
+                done += item.file.size;
+                overall.value = total ? done / total : 1;
+                send(i + 1);
+            });
+        }
+
+        function send(i) {
+            if (i >= queue.length) return finish();
+            var item = queue[i];
+            hash(item);
+
+            if (item.file.size > chunkSize) {
+                return sendChunked(item, function(sent) { progress(item, sent); }, function(res) { handled(i, item, res); });
+            }
+
+            var data = new FormData();
+            if (token) data.append('token', token.value);
+            data.append('relpath', item.path);
+            data.append('uploadfile', item.file, item.file.name);
+
+            var xhr = new XMLHttpRequest();
+            xhr.open('POST', 'upload');
+            xhr.setRequestHeader('Accept', 'application/json');
+            xhr.upload.addEventListener('progress', function(e) {
+                if (!e.lengthComputable) return;
+                progress(item, e.loaded / e.total * item.file.size);
+            });
+            xhr.addEventListener('load', function() { handled(i, item, parse(xhr)); });
+            xhr.addEventListener('error', function() { handled(i, item, {error: 'connection lost'}); });
+            xhr.send(data);
+        }
+
+        send(0);
+    });
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,487 @@
+package uploader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A small QR code encoder, just enough for the upload urls: byte mode,
+// error correction level M, versions 1 to 10 (up to 213 bytes).
+
+type qrVersion struct {
+	ecPerBlock int
+	blocks     []int // data codewords in each block
+	align      []int // alignment pattern centers
+}
+
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+func (v qrVersion) dataCodewords() int {
+	n := 0
+	for _, b := range v.blocks {
+		n += b
+	}
+	return n
+}
+
+type qrCode struct {
+	size     int
+	modules  [][]bool // true is dark
+	function [][]bool // finders, timing and the like; no data there
+}
+
+var errTooLong = errors.New("too long for a qr code")
+
+// encodeQR makes the smallest qr code that holds data.
+func encodeQR(data []byte) (*qrCode, error) {
+	for i, v := range qrVersions {
+		countBits := 8
+		if i+1 >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) > 8*v.dataCodewords() {
+			continue
+		}
+
+		var bits qrBits
+		bits.put(4, 4) // byte mode
+		bits.put(len(data), countBits)
+		for _, b := range data {
+			bits.put(int(b), 8)
+		}
+
+		capacity := 8 * v.dataCodewords()
+		bits.put(0, min4(capacity-len(bits)))
+		bits.put(0, (8-len(bits)%8)%8)
+		for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+			bits.put(pad, 8)
+		}
+
+		q := newQRCode(i + 1)
+		q.draw(v.codewords(bits.bytes()))
+		return q, nil
+	}
+	return nil, errTooLong
+}
+
+func min4(n int) int {
+	if n > 4 {
+		return 4
+	}
+	return n
+}
+
+type qrBits []bool
+
+func (b *qrBits) put(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (val>>uint(i))&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
+
+// codewords splits the data in blocks, adds error correction to each,
+// and interleaves the lot.
+func (v qrVersion) codewords(data []byte) []byte {
+	gen := rsGenerator(v.ecPerBlock)
+
+	var blocks, ecs [][]byte
+	for _, n := range v.blocks {
+		blocks = append(blocks, data[:n])
+		ecs = append(ecs, rsRemainder(data[:n], gen))
+		data = data[n:]
+	}
+
+	var out []byte
+	longest := v.blocks[len(v.blocks)-1]
+	for i := 0; i < longest; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8), modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= ((int(y) >> uint(i)) & 1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsGenerator is the reed-solomon generator polynomial of that degree,
+// highest coefficient first and the leading 1 left out.
+func rsGenerator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range gen {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < len(gen) {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return gen
+}
+
+func rsRemainder(data, gen []byte) []byte {
+	rem := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return rem
+}
+
+func newQRCode(version int) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{size: size}
+	q.modules = make([][]bool, size)
+	q.function = make([][]bool, size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.function[y] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	q.finder(3, 3)
+	q.finder(size-4, 3)
+	q.finder(3, size-4)
+
+	align := qrVersions[version-1].align
+	last := len(align) - 1
+	for i, y := range align {
+		for j, x := range align {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // on a finder
+			}
+			q.alignment(x, y)
+		}
+	}
+
+	// reserved for now, written once the mask is known
+	q.format(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 == 1
+			a, b := size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+
+	return q
+}
+
+// set puts a function module at column x, row y.
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) finder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= q.size || y >= q.size {
+				continue
+			}
+			d := maxAbs(dx, dy)
+			q.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (q *qrCode) alignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.set(cx+dx, cy+dy, maxAbs(dx, dy) != 1)
+		}
+	}
+}
+
+func maxAbs(a, b int) int {
+	if a < 0 {
+		a = -a
+	}
+	if b < 0 {
+		b = -b
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// format writes the error correction level (M) and mask, twice.
+func (q *qrCode) format(mask int) {
+	data := 0<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 == 1 }
+
+	for i := 0; i < 6; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// draw lays the codewords out in the zigzag, and picks the mask that
+// is easiest to read.
+func (q *qrCode) draw(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // around the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if upward {
+					y = q.size - 1 - vert
+				}
+				if q.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				q.modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+
+	best, lowest := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.format(mask)
+		if p := q.penalty(); lowest < 0 || p < lowest {
+			best, lowest = mask, p
+		}
+		q.applyMask(mask) // undo it
+	}
+	q.applyMask(best)
+	q.format(best)
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code would be to scan, by the rules of
+// the standard: long runs, blocks, things that look like finders, and
+// too much of either color.
+func (q *qrCode) penalty() int {
+	n := q.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	score := 0
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+
+			for x := 0; x+7 <= n; x++ {
+				match := true
+				for k, dark := range finderLike {
+					if at(x+k, y, transpose) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (q.lightRun(x-4, x, y, transpose) || q.lightRun(x+7, x+11, y, transpose)) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+
+	percent := dark * 100 / (n * n)
+	if percent < 50 {
+		score += (50 - percent) / 5 * 10
+	} else {
+		score += (percent - 50) / 5 * 10
+	}
+	return score
+}
+
+// lightRun is whether the modules from..to of a line are all light;
+// the quiet zone around the code counts as light.
+func (q *qrCode) lightRun(from, to, y int, transpose bool) bool {
+	for x := from; x < to; x++ {
+		if x < 0 || x >= q.size {
+			continue
+		}
+		if transpose && q.modules[x][y] || !transpose && q.modules[y][x] {
+			return false
+		}
+	}
+	return true
+}
+
+// qrQuiet is the margin, in modules, around the code.
+const qrQuiet = 4
+
+// write draws the code with half blocks, two rows to a line, in the
+// colors of the terminal. On a dark background the light modules are
+// the ones drawn, on a light one the dark modules, so that either way
+// the code comes out dark on light.
+func (q *qrCode) write(w io.Writer, lightBackground bool) error {
+	drawn := func(x, y int) bool {
+		if x < -qrQuiet || y < -qrQuiet || x >= q.size+qrQuiet || y >= q.size+qrQuiet {
+			return false
+		}
+		dark := x >= 0 && y >= 0 && x < q.size && y < q.size && q.modules[y][x]
+		return dark == lightBackground
+	}
+
+	var sb strings.Builder
+	for y := -qrQuiet; y < q.size+qrQuiet; y += 2 {
+		for x := -qrQuiet; x < q.size+qrQuiet; x++ {
+			top, bottom := drawn(x, y), drawn(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// lightTerminal guesses whether the terminal has a light background,
+// from the COLORFGBG some of them set; eg: 0;15 is black on white.
+func lightTerminal() bool {
+	v := os.Getenv("COLORFGBG")
+	bg, err := strconv.Atoi(v[strings.LastIndexByte(v, ';')+1:])
+	return err == nil && (bg == 7 || bg >= 9 && bg <= 15)
+}
@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The HELLO WORLD example of the standard, at 1-M: its data codewords,
+// and the error correction that goes with them.
+func TestRSRemainder(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if got := rsRemainder(data, rsGenerator(10)); !bytes.Equal(got, want) {
+		t.Errorf("ec codewords = %v, want %v", got, want)
+	}
+}
+
+// readBits reads n modules starting at i = 0, most significant last.
+func readBits(q *qrCode, n int, at func(i int) (x, y int)) int {
+	bits := 0
+	for i := 0; i < n; i++ {
+		if x, y := at(i); q.modules[y][x] {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits
+}
+
+func TestFormatBits(t *testing.T) {
+	// level M, masks 0 to 7, from the table of the standard
+	want := []string{
+		"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+		"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+	}
+
+	for mask, w := range want {
+		q := newQRCode(1)
+		q.format(mask)
+
+		// the copy split between the bottom left and top right
+		got := readBits(q, 15, func(i int) (int, int) {
+			if i < 8 {
+				return q.size - 1 - i, 8
+			}
+			return 8, q.size - 15 + i
+		})
+		if bits, _ := strconv.ParseInt(w, 2, 0); got != int(bits) {
+			t.Errorf("mask %v: format bits %015b, want %v", mask, got, w)
+		}
+	}
+}
+
+func TestVersionBits(t *testing.T) {
+	q := newQRCode(7)
+	got := readBits(q, 18, func(i int) (int, int) { return q.size - 11 + i%3, i / 3 })
+	if want := 0x7c94; got != want { // 000111 110010 010100
+		t.Errorf("version 7 bits = %018b, want %018b", got, want)
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	tests := []struct {
+		n       int
+		version int
+	}{
+		{1, 1}, {14, 1}, {15, 2}, {84, 5}, {85, 6}, {213, 10},
+	}
+	for _, tt := range tests {
+		q, err := encodeQR(bytes.Repeat([]byte("a"), tt.n))
+		if err != nil {
+			t.Errorf("%v bytes: %v", tt.n, err)
+			continue
+		}
+		if want := 17 + 4*tt.version; q.size != want {
+			t.Errorf("%v bytes: size %v, want %v", tt.n, q.size, want)
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, 214)); err != errTooLong {
+		t.Errorf("214 bytes: %v, want %v", err, errTooLong)
+	}
+}
+
+func TestWriteQuietZone(t *testing.T) {
+	q, err := encodeQR([]byte("http://192.0.2.1:9090/?token=abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, light := range []bool{false, true} {
+		var buf bytes.Buffer
+		q.write(&buf, light)
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+
+		side := q.size + 2*qrQuiet
+		if len(lines) != (side+1)/2 {
+			t.Errorf("light %v: %v lines, want %v", light, len(lines), (side+1)/2)
+		}
+
+		// the first two lines are the top of the quiet zone, and the
+		// quiet zone is drawn on a dark background only
+		quiet := strings.Repeat(" ", side)
+		if !light {
+			quiet = strings.Repeat("█", side)
+		}
+		for _, line := range lines[:qrQuiet/2] {
+			if line != quiet {
+				t.Errorf("light %v: quiet zone line %q", light, line)
+			}
+		}
+
+		// the top left finder starts right after the quiet zone, dark
+		// on light either way
+		row := []rune(lines[qrQuiet/2])
+		if len(row) != side {
+			t.Fatalf("light %v: line of %v modules, want %v", light, len(row), side)
+		}
+		corner := row[qrQuiet]
+		if light && corner != '█' || !light && corner != ' ' {
+			t.Errorf("light %v: finder corner drawn as %q", light, corner)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// psy upld send pushes files to another uploader, the way the upload
+// page does: a request per file, and large files in chunks, so that a
+// dropped connection only costs the chunk it was on.
+
+type sendSession struct {
+	token       string
+	tls         bool
+	fingerprint string
+	retries     int
+}
+
+func send(conf *config, args []string) error {
+	sess := sendSession{}
+	sendCmd := flag.NewFlagSet("upld send", flag.ExitOnError)
+	sendCmd.StringVar(&sess.token, "token", "", "<token> - the token the other uploader printed")
+	sendCmd.BoolVar(&sess.tls, "tls", conf.TLS, "the other uploader serves https")
+	sendCmd.StringVar(&sess.fingerprint, "fingerprint", "", "<sha-256> - with -tls, the certificate fingerprint the other uploader printed")
+	sendCmd.IntVar(&sess.retries, "retries", 3, "<n> - how many times to try again when the network fails")
+	sendCmd.Usage = func() {
+		fmt.Fprintln(sendCmd.Output(), "usage: psy upld send [flags] <host[:port] or upload url> <files or dirs...>")
+		sendCmd.PrintDefaults()
+	}
+	sendCmd.Parse(args)
+
+	if sendCmd.NArg() < 2 {
+		sendCmd.Usage()
+		return errors.New("wrong usage")
+	}
+
+	c, err := newClient(sendCmd.Arg(0), conf.Port, &sess)
+	if err != nil {
+		return err
+	}
+
+	files, err := collect(sendCmd.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	var sent, failed int
+	var total int64
+	for _, f := range files {
+		file, err := c.sendFile(f)
+		if e, ok := err.(*httpError); ok && (e.status == http.StatusUnauthorized || e.status == http.StatusTooManyRequests) {
+			// the rest would only get the same, and count as more
+			// wrong tokens
+			if c.token == "" {
+				return errors.New("the other uploader wants its token; pass it with -token")
+			}
+			return err
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, " ", f.path+":", err)
+			failed++
+			continue
+		}
+		sent++
+		total += file.Size
+	}
+
+	fmt.Printf("sent %v of %v files, %v\n", sent, len(files), formatSize(total))
+	if failed > 0 {
+		return fmt.Errorf("could not send %v of the files", failed)
+	}
+	return nil
+}
+
+// outgoing is a file to send, and the path it should get on the other
+// side.
+type outgoing struct {
+	path string
+	name string
+	size int64
+}
+
+// collect finds the files to send. Directories are sent whole, under
+// their own name, like the folder upload of the page.
+func collect(args []string) ([]outgoing, error) {
+	var files []outgoing
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, outgoing{arg, filepath.Base(arg), fi.Size()})
+			continue
+		}
+
+		root, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+		top := filepath.Base(root)
+
+		err = filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			files = append(files, outgoing{file, filepath.ToSlash(filepath.Join(top, rel)), fi.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+type client struct {
+	base    url.URL
+	token   string
+	retries int
+	http    *http.Client
+}
+
+// newClient takes either host[:port], or one of the urls the other
+// uploader printed, token and all.
+func newClient(target string, port int, sess *sendSession) (*client, error) {
+	c := &client{
+		base:    url.URL{Scheme: "http", Host: target},
+		token:   sess.token,
+		retries: sess.retries,
+	}
+
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		c.base = url.URL{Scheme: u.Scheme, Host: u.Host}
+		if token := u.Query().Get(tokenField); token != "" && c.token == "" {
+			c.token = token
+		}
+	} else if sess.tls {
+		c.base.Scheme = "https"
+	}
+
+	if c.base.Scheme != "http" && c.base.Scheme != "https" {
+		return nil, fmt.Errorf("can not send over %v", c.base.Scheme)
+	}
+	if c.base.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %v", target)
+	}
+	if c.base.Port() == "" {
+		c.base.Host = net.JoinHostPort(c.base.Hostname(), strconv.Itoa(port))
+	}
+
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if c.base.Scheme == "https" {
+		transport.TLSClientConfig = pinned(sess.fingerprint)
+	}
+	c.http = &http.Client{Transport: transport}
+
+	return c, nil
+}
+
+type fingerprintError struct {
+	got string
+}
+
+func (e fingerprintError) Error() string {
+	return "the certificate is not the one expected, its fingerprint is " + e.got
+}
+
+// pinned checks the certificate against the fingerprint the uploader
+// printed, since it is self-signed and nothing else vouches for it.
+// Without one, it only says what the fingerprint is.
+func pinned(want string) *tls.Config {
+	normal := func(s string) string {
+		return strings.ToUpper(strings.NewReplacer(":", "", " ", "").Replace(s))
+	}
+	want = normal(want)
+
+	var once sync.Once
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("no certificate")
+			}
+
+			got := fingerprint(raw[0])
+			if want == "" {
+				once.Do(func() {
+					fmt.Fprintln(os.Stderr, "warning: not checking the certificate; its sha-256 fingerprint is")
+					fmt.Fprintln(os.Stderr, " ", got)
+				})
+				return nil
+			}
+			if normal(got) != want {
+				return fingerprintError{got}
+			}
+			return nil
+		},
+	}
+}
+
+// httpError is an answer from the other uploader other than a 2xx.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%v (%v)", e.msg, e.status)
+}
+
+// retryable is whether trying again could help: the network failed, or
+// the other side did, or the file got mangled on the way.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *httpError:
+		if e.status == http.StatusInsufficientStorage {
+			return false // it will not fit any better the next time
+		}
+		return e.status >= 500 || e.status == http.StatusUnprocessableEntity
+	case *url.Error:
+		_, wrongCert := e.Err.(fingerprintError)
+		return !wrongCert
+	}
+	return false
+}
+
+func (c *client) newRequest(method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.base
+	u.Path = path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set(tokenHeader, c.token)
+	}
+	return req, nil
+}
+
+// do sends the request, and reads the json answer into v.
+func (c *client) do(req *http.Request, v interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dat, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		msg := strings.TrimSpace(string(dat))
+		var res uploadResult
+		if json.Unmarshal(dat, &res) == nil && res.Error != "" {
+			msg = res.Error
+		}
+		return &httpError{resp.StatusCode, msg}
+	}
+
+	return json.Unmarshal(dat, v)
+}
+
+func (c *client) sendFile(f outgoing) (received, error) {
+	p := newProgress(os.Stderr, f.name, f.size)
+
+	var file received
+	var sum, id string
+	var err error
+	wait := time.Second
+	for attempt := 0; ; attempt++ {
+		if f.size > chunkSize {
+			if sum == "" {
+				p.draw("hashing")
+				sum, err = hashFile(f.path)
+				if err != nil {
+					break
+				}
+			}
+			file, err = c.sendChunked(f, sum, &id, p)
+		} else {
+			file, sum, err = c.sendWhole(f, p)
+		}
+
+		if err == nil || attempt >= c.retries || !retryable(err) {
+			break
+		}
+		p.draw(fmt.Sprintf("retrying in %v", wait))
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	if err == nil && file.Sha256 != sum {
+		err = fmt.Errorf("checksum mismatch: sent %v, the other side got %v", sum, file.Sha256)
+	}
+	if err != nil {
+		p.finish("failed")
+		return received{}, err
+	}
+
+	status := "ok, sha-256 verified"
+	if file.Name != f.name {
+		status = "ok, as " + file.Name
+	}
+	p.finish(status)
+	return file, nil
+}
+
+// sendWhole posts the file like the upload page does, and hashes it on
+// the way out.
+func (c *client) sendWhole(f outgoing, p *progress) (received, string, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return received{}, "", err
+	}
+	defer file.Close()
+
+	// the parts around the file, so that the length is known up front
+	// and the uploader can turn away what is too large right away
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	mw.WriteField("relpath", f.name)
+	if _, err := mw.CreateFormFile("uploadfile", path.Base(f.name)); err != nil {
+		return received{}, "", err
+	}
+	n := head.Len()
+	mw.Close()
+	tail := append([]byte(nil), head.Bytes()[n:]...)
+	head.Truncate(n)
+
+	p.set(0)
+	h := sha256.New()
+	body := io.MultiReader(&head, io.TeeReader(file, io.MultiWriter(h, p)), bytes.NewReader(tail))
+
+	req, err := c.newRequest("POST", "/upload", nil, body)
+	if err != nil {
+		return received{}, "", err
+	}
+	req.ContentLength = int64(n) + f.size + int64(len(tail))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var res uploadResult
+	if err := c.do(req, &res); err != nil {
+		return received{}, "", err
+	}
+	if len(res.Files) != 1 {
+		return received{}, "", errors.New("the other side did not say what it got")
+	}
+	return res.Files[0], hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sendChunked carries on with the upload id, if there is one, or
+// starts a new one.
+func (c *client) sendChunked(f outgoing, sum string, id *string, p *progress) (received, error) {
+	var part partial
+	if *id != "" {
+		req, err := c.newRequest("GET", "/chunks/"+*id, nil, nil)
+		if err != nil {
+			return received{}, err
+		}
+		err = c.do(req, &part)
+		if e, ok := err.(*httpError); ok && e.status == http.StatusNotFound {
+			*id = ""
+		} else if err != nil {
+			return received{}, err
+		}
+	}
+
+	if *id == "" {
+		start, _ := json.Marshal(map[string]interface{}{"name": f.name, "size": f.size, "sha256": sum})
+		req, err := c.newRequest("POST", "/chunks", nil, bytes.NewReader(start))
+		if err != nil {
+			return received{}, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := c.do(req, &part); err != nil {
+			return received{}, err
+		}
+		*id = part.ID
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return received{}, err
+	}
+	defer file.Close()
+
+	gaps := missing(part.Received, f.size)
+	left := int64(0)
+	for _, gap := range gaps {
+		left += gap.End - gap.Start
+	}
+	p.set(f.size - left)
+
+	for _, gap := range gaps {
+		for offset := gap.Start; offset < gap.End; offset += part.ChunkSize {
+			end := offset + part.ChunkSize
+			if end > gap.End {
+				end = gap.End
+			}
+
+			chunk := io.TeeReader(io.NewSectionReader(file, offset, end-offset), p)
+			req, err := c.newRequest("PUT", "/chunks/"+*id, url.Values{"offset": {strconv.FormatInt(offset, 10)}}, chunk)
+			if err != nil {
+				return received{}, err
+			}
+			req.ContentLength = end - offset
+			req.Header.Set("Content-Type", "application/octet-stream")
+			if err := c.do(req, &part); err != nil {
+				return received{}, err
+			}
+		}
+	}
+
+	finish, _ := json.Marshal(map[string]string{"sha256": sum})
+	req, err := c.newRequest("POST", "/chunks/"+*id, nil, bytes.NewReader(finish))
+	if err != nil {
+		return received{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var res uploadResult
+	err = c.do(req, &res)
+	if e, ok := err.(*httpError); ok && e.status == http.StatusUnprocessableEntity {
+		*id = "" // the other side threw it away
+	}
+	if err != nil {
+		return received{}, err
+	}
+	if len(res.Files) != 1 {
+		return received{}, errors.New("the other side did not say what it got")
+	}
+	return res.Files[0], nil
+}
+
+// missing is what is not in the spans received so far, which are in
+// order and merged.
+func missing(have []span, size int64) []span {
+	var gaps []span
+	at := int64(0)
+	for _, sp := range have {
+		if sp.Start > at {
+			gaps = append(gaps, span{at, sp.Start})
+		}
+		if sp.End > at {
+			at = sp.End
+		}
+	}
+	if at < size {
+		gaps = append(gaps, span{at, size})
+	}
+	return gaps
+}
+
+// progress is a bar for one file, redrawn in place on terminals; other
+// outputs only get a line when something happens.
+type progress struct {
+	out   io.Writer
+	live  bool
+	name  string
+	size  int64
+	done  int64
+	drawn time.Time
+}
+
+func newProgress(out *os.File, name string, size int64) *progress {
+	fi, err := out.Stat()
+	live := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	return &progress{out: out, live: live, name: name, size: size}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw("")
+	}
+	return len(b), nil
+}
+
+func (p *progress) set(done int64) {
+	p.done = done
+	p.draw("")
+}
+
+func (p *progress) line(status string) string {
+	percent := int64(100)
+	if p.size > 0 {
+		percent = p.done * 100 / p.size
+	}
+
+	const width = 20
+	filled := int(percent * width / 100)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", width-filled)
+
+	return fmt.Sprintf("%-30.30s [%v] %3d%% %8v %-24.24s", p.name, bar, percent, formatSize(p.size), status)
+}
+
+func (p *progress) draw(status string) {
+	p.drawn = time.Now()
+	switch {
+	case p.live:
+		fmt.Fprint(p.out, "\r", p.line(status))
+	case status != "":
+		fmt.Fprintln(p.out, strings.TrimRight(p.line(status), " "))
+	}
+}
+
+func (p *progress) finish(status string) {
+	if p.live {
+		fmt.Fprint(p.out, "\r")
+	}
+	fmt.Fprintln(p.out, strings.TrimRight(p.line(status), " "))
+}
@@ -0,0 +1,138 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A chunk that fails on the way is sent again after asking the other
+// side what it has, and only what is missing goes over the wire again.
+func TestSendResumes(t *testing.T) {
+	s, _, done := testServer(t, collisionRename)
+	defer done()
+
+	var mu sync.Mutex
+	var offsets []string
+	failed := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			mu.Lock()
+			offset := r.URL.Query().Get("offset")
+			offsets = append(offsets, offset)
+			fail := !failed && offset != "0"
+			failed = failed || fail
+			mu.Unlock()
+
+			if fail {
+				io.Copy(ioutil.Discard, r.Body)
+				http.Error(w, "the disk hiccuped", http.StatusInternalServerError)
+				return
+			}
+		}
+		s.mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	src, err := ioutil.TempDir("", "psy-send-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	big := make([]byte, 2*chunkSize+1000)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	dir := filepath.Join(src, "stuff")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "big.bin"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "small.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := send(defaultConfig(), []string{"-retries", "1", ts.URL, dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first chunk once, the second twice
+	second, third := strconv.Itoa(chunkSize), strconv.Itoa(2*chunkSize)
+	want := []string{"0", second, second, third}
+	if strings.Join(offsets, " ") != strings.Join(want, " ") {
+		t.Errorf("chunks sent at %v, want %v", offsets, want)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(s.conf.Dir, "stuff", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, big) {
+		t.Errorf("got %v bytes, not the ones sent", len(got))
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(s.conf.Dir, sumsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(big)
+	small := sha256.Sum256([]byte("hi"))
+	for _, line := range []string{
+		hex.EncodeToString(sum[:]) + "  stuff/big.bin",
+		hex.EncodeToString(small[:]) + "  stuff/small.txt",
+	} {
+		if !strings.Contains(string(manifest), line+"\n") {
+			t.Errorf("%v has no %q:\n%s", sumsFile, line, manifest)
+		}
+	}
+}
+
+func TestRunWrongToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "psy-upld-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// no config of the one running the tests
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	conf := defaultConfig()
+	conf.Dir = filepath.Join(dir, "uploads")
+	s, err := newServer(conf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	file := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Run([]string{"send", "-token", "wrong", ts.URL, file}); err == nil {
+		t.Error("a wrong token was not an error")
+	}
+	if err := Run([]string{"send", ts.URL, file}); err == nil {
+		t.Error("no token was not an error")
+	}
+	if err := Run([]string{"send", "-token", s.auth.token, ts.URL, file}); err != nil {
+		t.Errorf("the right token: %v", err)
+	}
+}
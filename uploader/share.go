@@ -0,0 +1,92 @@
+package uploader
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// hiddenFS keeps dot files out of what is shared; they are either
+// someone's configuration, or uploads that are not done yet.
+type hiddenFS struct {
+	fs http.FileSystem
+}
+
+func hidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func (h hiddenFS) Open(name string) (http.File, error) {
+	if hidden(name) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := h.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return hiddenFile{f}, nil
+}
+
+type hiddenFile struct {
+	http.File
+}
+
+func (f hiddenFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+
+	shown := infos[:0]
+	for _, fi := range infos {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			shown = append(shown, fi)
+		}
+	}
+	return shown, err
+}
+
+// serveDir serves the files under dir at prefix, with listings and
+// range requests, to whoever has the token.
+func (s *server) serveDir(prefix, dir string) {
+	files := http.StripPrefix(prefix, http.FileServer(hiddenFS{http.Dir(dir)}))
+
+	s.mux.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorize(w, r) {
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// authorize lets the request through if it has the token, and answers
+// it otherwise.
+func (s *server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if !s.auth.enabled() {
+		return true
+	}
+
+	ip := clientIP(r)
+	if s.auth.blocked(ip) {
+		http.Error(w, "too many wrong tokens, try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	token := tokenOf(r)
+	if token == "" {
+		http.Error(w, "a token is needed; open the upload page with it first", http.StatusUnauthorized)
+		return false
+	}
+	if !s.auth.check(ip, token) {
+		http.Error(w, "wrong token", http.StatusUnauthorized)
+		return false
+	}
+
+	if r.URL.Query().Get(tokenField) != "" {
+		s.auth.setCookie(w)
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const sumsFile = "SHA256SUMS"
+
+// sums keeps a SHA256SUMS in the upload dir, in the format of
+// sha256sum, so that `sha256sum -c SHA256SUMS` checks everything that
+// was received.
+type sums struct {
+	mu sync.Mutex
+}
+
+// record adds the file to the manifest, in place of what was there for
+// the same path before.
+func (m *sums) record(dir string, file received) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := filepath.Join(dir, sumsFile)
+	dat, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(dat))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if parts := strings.SplitN(line, "  ", 2); len(parts) == 2 && parts[1] == file.Name {
+			continue
+		}
+		fmt.Fprintln(&out, line)
+	}
+	fmt.Fprintf(&out, "%v  %v\n", file.Sha256, file.Name)
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,136 @@
+package uploader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// certificate makes up a self-signed certificate for the addresses the
+// uploader can be reached at. Kept ones are reused for as long as they
+// still cover those.
+func certificate(ips []net.IP, keep bool) (tls.Certificate, error) {
+	ips = append(append([]net.IP{}, ips...), net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil {
+		names = append(names, host)
+	}
+
+	if !keep {
+		return generateCert(ips, names, 30*24*time.Hour)
+	}
+
+	dir := configDir()
+	if dir == "" {
+		return tls.Certificate{}, errors.New("no HOME to keep the certificate in")
+	}
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && covers(cert, ips) {
+		return cert, nil
+	}
+
+	cert, err := generateCert(ips, names, 365*24*time.Hour)
+	if err != nil {
+		return cert, err
+	}
+
+	return cert, saveCert(cert, certFile, keyFile)
+}
+
+func generateCert(ips []net.IP, names []string, valid time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"psy uploader"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(valid),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           ips,
+		DNSNames:              names,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// covers is true when cert is good for a while longer, for all of ips.
+func covers(cert tls.Certificate, ips []net.IP) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || time.Until(leaf.NotAfter) < 24*time.Hour {
+		return false
+	}
+
+	for _, ip := range ips {
+		if leaf.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func saveCert(cert tls.Certificate, certFile, keyFile string) error {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(certFile), 0700); err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return ioutil.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// fingerprint is the sha-256 of the certificate, the way browsers show
+// it.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
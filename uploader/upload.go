@@ -0,0 +1,261 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const resultHTML = `<html>
+<head>
+       <title>Upload file</title>
+</head>
+<body>
+<h1>{{if .Error}}Upload failed{{else}}Uploaded{{end}}</h1>
+{{if .Error}}<p>{{.Error}}</p>
+{{end}}<ul>
+{{range .Files}}    <li>{{.Name}} ({{.Size}} bytes) sha-256 <code>{{.Sha256}}</code></li>
+{{end}}</ul>
+<a href="upload">upload more</a>
+</body>
+</html>
+`
+
+var resultPage = template.Must(template.New("result-page").Parse(resultHTML))
+
+// received is a file that made it, with its path in the upload dir.
+type received struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// uploadResult is what is sent back; a page for browsers, json for
+// the upload page's script and anything else that asks for it.
+type uploadResult struct {
+	Files []received `json:"files"`
+	Error string     `json:"error,omitempty"`
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (s *server) report(w http.ResponseWriter, r *http.Request, status int, res *uploadResult) {
+	if wantsJSON(r) {
+		if res.Files == nil {
+			res.Files = []received{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	resultPage.Execute(w, res)
+}
+
+// isTooLarge tells the error of http.MaxBytesReader apart from the
+// rest; it has no type of its own to check for.
+func isTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// receive streams the parts of the upload form to disk as they come,
+// without holding on to them. The token field has to come before the
+// files, which is what browsers do with the upload page. A relpath
+// field before a file puts it in a subdirectory, for folder uploads;
+// the file name of the part can not carry it, as it only keeps the
+// last element of a path.
+func (s *server) receive(w http.ResponseWriter, r *http.Request, ip string) {
+	res := &uploadResult{}
+
+	if s.maxSize > 0 {
+		if r.ContentLength > s.maxSize {
+			res.Error = fmt.Sprintf("the upload is larger than the limit of %v bytes", s.maxSize)
+			s.report(w, r, http.StatusRequestEntityTooLarge, res)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxSize)
+	}
+
+	authed := !s.auth.enabled()
+	if token := tokenOf(r); token != "" && s.auth.enabled() {
+		if !s.auth.check(ip, token) {
+			res.Error = "wrong token"
+			s.report(w, r, http.StatusUnauthorized, res)
+			return
+		}
+		authed = true
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		res.Error = err.Error()
+		s.report(w, r, http.StatusBadRequest, res)
+		return
+	}
+
+	fail := func(err error) {
+		status := http.StatusBadRequest
+		if err == errExists {
+			status = http.StatusConflict
+		}
+		if isTooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+			err = fmt.Errorf("the upload is larger than the limit of %v bytes", s.maxSize)
+		}
+		log.Println("upload from", ip, "failed:", err)
+		res.Error = err.Error()
+		s.report(w, r, status, res)
+	}
+
+	relpath := ""
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		switch part.FormName() {
+		case tokenField:
+			if authed {
+				continue
+			}
+			token, err := ioutil.ReadAll(io.LimitReader(part, 256))
+			if err != nil {
+				fail(err)
+				return
+			}
+			if !s.auth.check(ip, strings.TrimSpace(string(token))) {
+				res.Error = "wrong token"
+				s.report(w, r, http.StatusUnauthorized, res)
+				return
+			}
+			s.auth.setCookie(w)
+			authed = true
+
+		case "relpath":
+			value, err := ioutil.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				fail(err)
+				return
+			}
+			relpath = string(value)
+
+		case "uploadfile":
+			if !authed {
+				s.auth.check(ip, "")
+				res.Error = "a token is needed before any file"
+				s.report(w, r, http.StatusUnauthorized, res)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+
+			// only a folder upload gets to say where the file goes;
+			// the file name alone can have a windows path in it
+			sent := part.FileName()
+			name, err := sanitizeName(sent)
+			if relpath != "" {
+				sent = relpath
+				name, err = sanitizePath(relpath)
+				relpath = ""
+			}
+			if err != nil {
+				fail(fmt.Errorf("%v: %v", sent, err))
+				return
+			}
+
+			file, err := s.save(part, name)
+			if err != nil {
+				fail(err)
+				return
+			}
+			res.Files = append(res.Files, file)
+			log.Println("uploaded file: ", file.Name)
+		}
+	}
+
+	if len(res.Files) == 0 {
+		res.Error = "no files were sent"
+		s.report(w, r, http.StatusBadRequest, res)
+		return
+	}
+
+	s.report(w, r, http.StatusOK, res)
+}
+
+// save writes the file next to where it goes, and only moves it there
+// once all of it arrived; a client going away leaves nothing behind.
+// name has to be sanitized already. The file is hashed on the way, and
+// the path it was saved under in the upload dir is returned; the
+// collision policy may have changed it.
+func (s *server) save(src io.Reader, name string) (received, error) {
+	dest := filepath.Join(s.conf.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return received{}, err
+	}
+
+	if s.collision == collisionReject {
+		// no need to take in all of it to find out
+		if _, err := os.Lstat(dest); err == nil {
+			return received{}, errExists
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), tempPrefix)
+	if err != nil {
+		return received{}, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// temp files are only for us to read
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return received{}, err
+	}
+
+	return s.keep(tmp.Name(), dest, size, hex.EncodeToString(h.Sum(nil)))
+}
+
+// keep moves a file that fully arrived in place, and writes down its
+// sum.
+func (s *server) keep(tmp, dest string, size int64, sum string) (received, error) {
+	placed, err := place(tmp, dest, s.collision)
+	if err != nil {
+		os.Remove(tmp)
+		return received{}, err
+	}
+
+	rel, err := filepath.Rel(s.conf.Dir, placed)
+	if err != nil {
+		return received{}, err
+	}
+
+	file := received{filepath.ToSlash(rel), size, sum}
+	return file, s.sums.record(s.conf.Dir, file)
+}
@@ -20,8 +20,15 @@ limitations under the License.
 
 package main
 
-import "github.com/psyomn/psy/uploader"
+import (
+	"log"
+	"os"
+
+	"github.com/psyomn/psy/uploader"
+)
 
 func main() {
-	uploader.Run(nil)
+	if err := uploader.Run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
 }